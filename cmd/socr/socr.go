@@ -2,7 +2,9 @@
 package main
 
 import (
+	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"path/filepath"
@@ -16,6 +18,8 @@ import (
 	"go.senan.xyz/socr/directories"
 	"go.senan.xyz/socr/importer"
 	"go.senan.xyz/socr/server"
+	"go.senan.xyz/socr/server/auth"
+	"go.senan.xyz/socr/server/oidc"
 
 	_ "image/gif"
 	_ "image/jpeg"
@@ -26,12 +30,28 @@ var (
 	confListenAddr     = mustEnv("SOCR_LISTEN_ADDR")
 	confDBDSN          = mustEnv("SOCR_DB_DSN")
 	confHMACSecret     = mustEnv("SOCR_HMAC_SECRET")
-	confLoginUsername  = mustEnv("SOCR_LOGIN_USERNAME")
-	confLoginPassword  = mustEnv("SOCR_LOGIN_PASSWORD")
-	confAPIKey         = mustEnv("SOCR_API_KEY")
+	confLoginUsername  = envOr("SOCR_LOGIN_USERNAME", "")
+	confLoginPassword  = envOr("SOCR_LOGIN_PASSWORD", "")
+	confAPIKey         = envOr("SOCR_API_KEY", "")
 	confDirs           = envDirs("SOCR_DIR_")
 	confUploadsAlias   = envOr("SOCR_UPLOADS_DIR_ALIAS", "uploads")
 	confThumbnailWidth = envOrInt("SOCR_THUMBNAIL_WIDTH", 315)
+	confTextSearch     = envOr("SOCR_TEXT_SEARCH_CONFIG", "english")
+	confTrashRetention = envOrInt("SOCR_TRASH_RETENTION_DAYS", 30)
+	confRateLimits     = server.Limits{
+		IP:             envOrInt("SOCR_RATE_LIMIT_IP", 1200),
+		Login:          envOrInt("SOCR_RATE_LIMIT_LOGIN", 10),
+		Upload:         envOrInt("SOCR_RATE_LIMIT_UPLOAD", 60),
+		LoginAttempts:  envOrInt("SOCR_LOGIN_LOCKOUT_ATTEMPTS", 5),
+		TrustedProxies: envCIDRs("SOCR_TRUSTED_PROXIES"),
+	}
+	confAuthHeader        = envOr("SOCR_AUTH_HEADER", "")
+	confAuthCreateUsers   = envOr("SOCR_AUTH_CREATE_USERS", "") == "true"
+	confOIDCIssuer        = envOr("SOCR_OIDC_ISSUER", "")
+	confOIDCClientID      = envOr("SOCR_OIDC_CLIENT_ID", "")
+	confOIDCClientSecret  = envOr("SOCR_OIDC_CLIENT_SECRET", "")
+	confOIDCRedirectURL   = envOr("SOCR_OIDC_REDIRECT_URL", "")
+	confOIDCUsernameClaim = envOr("SOCR_OIDC_USERNAME_CLAIM", "preferred_username")
 )
 
 func main() {
@@ -42,7 +62,7 @@ func main() {
 		log.Printf("using directory alias %q path %q", alias, path)
 	}
 
-	dbc, err := db.New(confDBDSN)
+	dbc, err := db.New(confDBDSN, confTextSearch)
 	if err != nil {
 		log.Panicf("error creating database: %v", err)
 	}
@@ -51,6 +71,15 @@ func main() {
 	if err := dbc.Migrate(); err != nil {
 		log.Panicf("error running migrations: %v", err)
 	}
+	if err := dbc.RefreshTextSearches(); err != nil {
+		log.Panicf("error refreshing text search with config %q: %v", confTextSearch, err)
+	}
+	if err := createFirstAdmin(dbc); err != nil {
+		log.Panicf("error creating first admin: %v", err)
+	}
+	if err := dbc.SetEnvAPIKey(envTokenHash()); err != nil {
+		log.Panicf("error setting api key: %v", err)
+	}
 
 	const numImportWorkers = 1
 	importr := importer.New(dbc, png.Encode, "image/png", confDirs, confUploadsAlias, uint(confThumbnailWidth))
@@ -63,10 +92,18 @@ func main() {
 			log.Printf("error starting watcher: %v", err)
 		}
 	}()
+	go func() {
+		if err := importr.ImportMissingColours(); err != nil {
+			log.Printf("error importing missing colours: %v", err)
+		}
+	}()
 
-	servr := server.New(dbc, importr, confDirs, confUploadsAlias, confHMACSecret, confLoginUsername, confLoginPassword, confAPIKey)
+	servr := server.New(dbc, importr, confDirs, confUploadsAlias, confHMACSecret, confRateLimits, externalAuth())
 	go servr.SocketNotifyScannerUpdate()
 	go servr.SocketNotifyMedia()
+	if confTrashRetention > 0 {
+		go servr.PurgeTrash(time.Duration(confTrashRetention) * 24 * time.Hour)
+	}
 
 	router := servr.Router()
 	server := http.Server{
@@ -83,6 +120,60 @@ func main() {
 	log.Printf("starting server: %v", server.ListenAndServe())
 }
 
+// createFirstAdmin creates an admin from the login env vars when there are no users
+// yet. after that, users are managed from the api
+func createFirstAdmin(dbc *db.DB) error {
+	count, err := dbc.CountUsers()
+	if err != nil {
+		return fmt.Errorf("counting users: %w", err)
+	}
+	if count > 0 {
+		return nil
+	}
+	if confLoginUsername == "" || confLoginPassword == "" {
+		return fmt.Errorf("please provide a %q and %q for the first admin", "SOCR_LOGIN_USERNAME", "SOCR_LOGIN_PASSWORD")
+	}
+	passwordHash, err := auth.PasswordHash(confLoginPassword)
+	if err != nil {
+		return fmt.Errorf("hashing password: %w", err)
+	}
+	if _, err := dbc.CreateFirstAdmin(confLoginUsername, passwordHash); err != nil {
+		return fmt.Errorf("creating user: %w", err)
+	}
+	log.Printf("created admin %q", confLoginUsername)
+	return nil
+}
+
+func externalAuth() server.ExternalAuth {
+	external := server.ExternalAuth{
+		Header:      confAuthHeader,
+		CreateUsers: confAuthCreateUsers,
+	}
+	if external.Header != "" {
+		if len(confRateLimits.TrustedProxies) == 0 {
+			log.Fatalf("please provide a %q to trust %q from", "SOCR_TRUSTED_PROXIES", "SOCR_AUTH_HEADER")
+		}
+		log.Printf("using auth header %q from trusted proxies", external.Header)
+	}
+	if confOIDCIssuer != "" {
+		if confOIDCClientID == "" || confOIDCRedirectURL == "" {
+			log.Fatalf("please provide a %q and %q for %q", "SOCR_OIDC_CLIENT_ID", "SOCR_OIDC_REDIRECT_URL", "SOCR_OIDC_ISSUER")
+		}
+		external.OIDC = oidc.New(confOIDCIssuer, confOIDCClientID, confOIDCClientSecret, confOIDCRedirectURL, confOIDCUsernameClaim)
+		log.Printf("using oidc issuer %q", confOIDCIssuer)
+	}
+	return external
+}
+
+// envAPIKeyHash is the hash of the upload only api key from the env, if there is one.
+// more keys can be created from the api
+func envTokenHash() string {
+	if confAPIKey == "" {
+		return ""
+	}
+	return auth.TokenHash(confAPIKey)
+}
+
 func mustEnv(key string) string {
 	if v, ok := os.LookupEnv(key); ok {
 		return v
@@ -107,6 +198,30 @@ func envOrInt(key string, or int) int {
 	return or
 }
 
+// envCIDRs parses a comma separated list of cidrs or single ips
+func envCIDRs(key string) []*net.IPNet {
+	var cidrs []*net.IPNet
+	for _, v := range strings.Split(os.Getenv(key), ",") {
+		v = strings.TrimSpace(v)
+		if v == "" {
+			continue
+		}
+		if !strings.Contains(v, "/") {
+			if ip := net.ParseIP(v); ip != nil && ip.To4() != nil {
+				v += "/32"
+			} else {
+				v += "/128"
+			}
+		}
+		_, cidr, err := net.ParseCIDR(v)
+		if err != nil {
+			log.Fatalf("please provide a valid %q: %v", key, err)
+		}
+		cidrs = append(cidrs, cidr)
+	}
+	return cidrs
+}
+
 func envDirs(prefix string) directories.Directories {
 	expr := regexp.MustCompile(prefix + `(?P<Alias>[\w_]+)=(?P<Path>.*)`)
 	const (
@@ -0,0 +1,64 @@
+package db
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// SearchCursor is the position of a media in sorted search results, used for keyset
+// pagination. clients are given it as an opaque token
+type SearchCursor struct {
+	SortField    string    `json:"f"`
+	SortOrder    string    `json:"o"`
+	StarredFirst bool      `json:"sf,omitempty"`
+	Starred      bool      `json:"st,omitempty"`
+	Timestamp    time.Time `json:"t,omitzero"`
+	Score        float64   `json:"s,omitempty"`
+	ID           MediaID   `json:"i"`
+}
+
+func NewSearchCursor(options SearchMediasOptions, media *Media) *SearchCursor {
+	cursor := &SearchCursor{
+		SortField: options.SortField,
+		SortOrder: options.SortOrder,
+		ID:        media.ID,
+	}
+	if options.StarredFirst {
+		cursor.StarredFirst = true
+		cursor.Starred = media.Starred
+	}
+	switch options.SortField {
+	case SortFieldTimestamp:
+		cursor.Timestamp = media.Timestamp
+	case SortFieldSimilarity:
+		cursor.Score = media.Similarity
+	case SortFieldRank:
+		cursor.Score = media.Rank
+	case SortFieldColour:
+		cursor.Score = media.ColourDistance
+	case SortFieldPosition:
+		if media.Position != nil {
+			cursor.Score = float64(*media.Position)
+		}
+	}
+	return cursor
+}
+
+func (c *SearchCursor) Encode() string {
+	raw, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(raw)
+}
+
+func DecodeSearchCursor(token string) (*SearchCursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, fmt.Errorf("decode base64: %w", err)
+	}
+	var cursor SearchCursor
+	if err := json.Unmarshal(raw, &cursor); err != nil {
+		return nil, fmt.Errorf("decode json: %w", err)
+	}
+	return &cursor, nil
+}
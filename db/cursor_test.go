@@ -0,0 +1,48 @@
+package db_test
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"go.senan.xyz/socr/db"
+)
+
+func TestSearchCursor(t *testing.T) {
+	media := &db.Media{
+		ID:         12,
+		Timestamp:  time.Date(2021, 5, 18, 13, 14, 30, 123456000, time.UTC),
+		Similarity: 0.1 + 0.2,
+		Starred:    true,
+	}
+
+	for _, field := range []string{db.SortFieldTimestamp, db.SortFieldSimilarity} {
+		options := db.SearchMediasOptions{SortField: field, SortOrder: "desc", StarredFirst: true}
+		cursor := db.NewSearchCursor(options, media)
+		decoded, err := db.DecodeSearchCursor(cursor.Encode())
+		if err != nil {
+			t.Fatalf("decoding cursor for %q: %v", field, err)
+		}
+		if !reflect.DeepEqual(cursor, decoded) {
+			t.Errorf("cursor for %q decoded %#v expected %#v", field, decoded, cursor)
+		}
+	}
+
+	if _, err := db.DecodeSearchCursor("not a cursor"); err == nil {
+		t.Errorf("expected error decoding invalid cursor")
+	}
+}
+
+func TestSearchCursorWithOffset(t *testing.T) {
+	options := db.SearchMediasOptions{
+		SortField: db.SortFieldTimestamp,
+		SortOrder: "desc",
+		Offset:    10,
+		After:     &db.SearchCursor{SortField: db.SortFieldTimestamp, SortOrder: "desc"},
+	}
+	// the options are checked before any query, so no connection is needed
+	if _, err := (&db.DB{}).SearchMedias(options); !errors.Is(err, db.ErrCursorWithOffset) {
+		t.Errorf("searching with a cursor and an offset got error %v expected %v", err, db.ErrCursorWithOffset)
+	}
+}
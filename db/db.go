@@ -3,15 +3,19 @@ package db
 import (
 	"context"
 	"embed"
+	"errors"
 	"fmt"
 	"io"
 	"io/fs"
 	"log"
+	"slices"
 	"sort"
+	"strings"
 	"time"
 
 	sq "github.com/Masterminds/squirrel"
 	"github.com/georgysavva/scany/pgxscan"
+	"github.com/jackc/pgconn"
 	"github.com/jackc/pgx/v4"
 	"github.com/jackc/pgx/v4/pgxpool"
 )
@@ -23,9 +27,10 @@ var migrations embed.FS
 type DB struct {
 	*pgxpool.Pool
 	sq.StatementBuilderType
+	textSearchConfig string
 }
 
-func New(dsn string) (*DB, error) {
+func New(dsn string, textSearchConfig string) (*DB, error) {
 	pool, err := waitConnect(context.Background(), dsn, 500*time.Millisecond, 10)
 	if err != nil {
 		return nil, fmt.Errorf("create and connect pool: %w", err)
@@ -34,6 +39,7 @@ func New(dsn string) (*DB, error) {
 	return &DB{
 		Pool:                 pool,
 		StatementBuilderType: sq.StatementBuilder.PlaceholderFormat(sq.Dollar),
+		textSearchConfig:     textSearchConfig,
 	}, nil
 }
 
@@ -111,8 +117,8 @@ func (db *DB) Migrate() error {
 func (db *DB) CreateMedia(media *Media) (*Media, error) {
 	q := db.
 		Insert("medias").
-		Columns("hash", "type", "mime", "timestamp", "dim_width", "dim_height", "dominant_colour", "blurhash").
-		Values(media.Hash, media.Type, media.MIME, media.Timestamp, media.DimWidth, media.DimHeight, media.DominantColour, media.Blurhash).
+		Columns("hash", "type", "mime", "timestamp", "dim_width", "dim_height", "dominant_colour", "blurhash", "owner_id").
+		Values(media.Hash, media.Type, media.MIME, media.Timestamp, media.DimWidth, media.DimHeight, media.DominantColour, media.Blurhash, media.OwnerID).
 		Suffix("returning *")
 
 	sql, args, _ := q.ToSql()
@@ -122,14 +128,42 @@ func (db *DB) CreateMedia(media *Media) (*Media, error) {
 
 type SearchMediasOptions struct {
 	Body      string
+	Match     MatchMode
 	Directory string
 	Media     MediaType
 	Limit     int
 	Offset    int
+	// After continues from a cursor instead of an offset, so both can't be used
+	After     *SearchCursor
 	SortField string
 	SortOrder string
 	DateFrom  time.Time
 	DateTo    time.Time
+	// Colour matches media with a dominant colour within ColourDistance of it
+	Colour         *Lab
+	ColourDistance float64
+	// dimensions are in pixels and inclusive, with zero meaning unbounded.
+	// aspect ratio is width over height
+	WidthMin    int
+	WidthMax    int
+	HeightMin   int
+	HeightMax   int
+	AspectMin   float64
+	AspectMax   float64
+	Orientation Orientation
+	// Tags matches media with any or all of the tags, depending on TagsMatch
+	Tags      []string
+	TagsMatch TagsMatch
+	// Collection matches media in the collection, and allows sorting by position
+	Collection CollectionID
+	// User is who is searching. Starred matches only media they have starred, and
+	// StarredFirst sorts media they have starred before the rest
+	User         UserID
+	Starred      bool
+	StarredFirst bool
+	// Library matches only the media a user can see, which are their own uploads and
+	// media which belong to nobody, such as those from scanned directories
+	Library UserID
 }
 
 func (db *DB) GetMediaByID(id int) (*Media, error) {
@@ -156,7 +190,231 @@ func (db *DB) GetMediaByHash(hash string) (*Media, error) {
 	return &result, pgxscan.Get(context.Background(), db, &result, sql, args...)
 }
 
-func (db *DB) GetMediaByHashWithRelations(hash string) (*Media, error) {
+// publicExpr is whether a media is public. media without a visibility of their own
+// are public unless any of their directories are private
+var publicExpr = sq.Expr(`coalesce(medias.visibility = 'public', not exists (
+	select 1 from dir_infos join directory_visibilities on directory_visibilities.directory_alias = dir_infos.directory_alias
+	where dir_infos.media_id = medias.id and directory_visibilities.visibility = 'private'))`)
+
+// CanViewMedias checks that every media of hashes is in library, see
+// SearchMediasOptions.Library. media in the trash can only be seen by whoever can
+// restore them. media which don't exist are ignored
+func (db *DB) CanViewMedias(library UserID, hashes ...string) (bool, error) {
+	return db.canAccessMedias(library, sq.Or{
+		sq.And{sq.NotEq{"owner_id": nil}, sq.NotEq{"owner_id": library}},
+		sq.And{sq.NotEq{"deleted_at": nil}, sq.Or{sq.Eq{"owner_id": nil}, sq.NotEq{"owner_id": library}}},
+	}, hashes)
+}
+
+// CanChangeMedias checks that every media of hashes belongs to library's user. media
+// from directories belong to no one, so only admins can change them
+func (db *DB) CanChangeMedias(library UserID, hashes ...string) (bool, error) {
+	return db.canAccessMedias(library, sq.Or{sq.Eq{"owner_id": nil}, sq.NotEq{"owner_id": library}}, hashes)
+}
+
+// canAccessMedias checks that no media of hashes matches denied, unless library is 0
+func (db *DB) canAccessMedias(library UserID, denied sq.Sqlizer, hashes []string) (bool, error) {
+	if library == 0 {
+		return true, nil
+	}
+	q := db.
+		Select("count(1)").
+		From("medias").
+		Where(sq.Eq{"hash": hashes}).
+		Where(denied)
+
+	sql, args, _ := q.ToSql()
+	var result int
+	if err := pgxscan.Get(context.Background(), db, &result, sql, args...); err != nil {
+		return false, err
+	}
+	return result == 0, nil
+}
+
+// IsMediaPublic finds if a media can be seen without logging in. media in the trash
+// can't be
+func (db *DB) IsMediaPublic(hash string) (bool, error) {
+	q := db.
+		Select().
+		Column(sq.Expr("medias.deleted_at is null and ?", publicExpr)).
+		From("medias").
+		Where(sq.Eq{"hash": hash})
+
+	sql, args, _ := q.ToSql()
+	var result bool
+	return result, pgxscan.Get(context.Background(), db, &result, sql, args...)
+}
+
+// SetMediaVisibility sets the visibility of a media, or with nil has it take its
+// directories' visibility
+func (db *DB) SetMediaVisibility(hash string, visibility *Visibility) error {
+	if visibility != nil && !isVisibility(*visibility) {
+		return fmt.Errorf("%w %q", ErrInvalidVisibility, *visibility)
+	}
+
+	q := db.
+		Update("medias").
+		Set("visibility", visibility).
+		Where(sq.Eq{"hash": hash}).
+		Suffix("returning id")
+
+	sql, args, _ := q.ToSql()
+	var id MediaID
+	return pgxscan.Get(context.Background(), db, &id, sql, args...)
+}
+
+// SetDirectoryVisibility sets the default visibility of media in a directory
+func (db *DB) SetDirectoryVisibility(alias string, visibility Visibility) error {
+	if !isVisibility(visibility) {
+		return fmt.Errorf("%w %q", ErrInvalidVisibility, visibility)
+	}
+
+	q := db.
+		Insert("directory_visibilities").
+		Columns("directory_alias", "visibility").
+		Values(alias, visibility).
+		Suffix("on conflict (directory_alias) do update set visibility = excluded.visibility")
+
+	sql, args, _ := q.ToSql()
+	_, err := db.Exec(context.Background(), sql, args...)
+	return err
+}
+
+// SetMediaStarred stars or unstars a media for a user
+func (db *DB) SetMediaStarred(hash string, user UserID, starred bool) error {
+	media, err := db.GetMediaByHash(hash)
+	if err != nil {
+		return err
+	}
+
+	var q sq.Sqlizer = db.
+		Delete("media_stars").
+		Where(sq.Eq{"media_id": media.ID, "user_id": user})
+	if starred {
+		q = db.
+			Insert("media_stars").
+			Columns("user_id", "media_id").
+			Values(user, media.ID).
+			Suffix("on conflict (user_id, media_id) do nothing")
+	}
+
+	sql, args, _ := q.ToSql()
+	_, err = db.Exec(context.Background(), sql, args...)
+	return err
+}
+
+// TrashMedias moves media to the trash, returning the hashes of the media which
+// were moved. deleteFiles is whether their files are deleted too when they're
+// deleted from the trash
+func (db *DB) TrashMedias(hashes []string, deleteFiles bool) ([]string, error) {
+	q := db.
+		Update("medias").
+		Set("deleted_at", sq.Expr("now()")).
+		Set("delete_files", deleteFiles).
+		Where("hash = any(?)", hashes).
+		Where("deleted_at is null").
+		Suffix("returning hash")
+
+	sql, args, _ := q.ToSql()
+	var results []string
+	return results, pgxscan.Select(context.Background(), db, &results, sql, args...)
+}
+
+// RestoreMedias moves media out of the trash, returning the hashes of the media which
+// were restored
+func (db *DB) RestoreMedias(hashes []string) ([]string, error) {
+	q := db.
+		Update("medias").
+		Set("deleted_at", nil).
+		Set("delete_files", false).
+		Where("hash = any(?)", hashes).
+		Where("deleted_at is not null").
+		Suffix("returning hash")
+
+	sql, args, _ := q.ToSql()
+	var results []string
+	return results, pgxscan.Select(context.Background(), db, &results, sql, args...)
+}
+
+// GetTrashedMedias finds the media in the trash, most recently trashed first. if owner
+// isn't 0, only their media are found
+func (db *DB) GetTrashedMedias(owner UserID, limit, offset int) ([]*Media, error) {
+	q := db.
+		Select("*").
+		From("medias").
+		Where("deleted_at is not null").
+		OrderBy("deleted_at desc", "id desc").
+		Limit(uint64(limit)).
+		Offset(uint64(offset))
+	if owner != 0 {
+		q = q.Where(sq.Eq{"owner_id": owner})
+	}
+
+	sql, args, _ := q.ToSql()
+	var results []*Media
+	return results, pgxscan.Select(context.Background(), db, &results, sql, args...)
+}
+
+// DeleteMedias permanently deletes media along with everything that references them,
+// and returns the hashes and files of the media that were deleted
+func (db *DB) DeleteMedias(hashes []string) ([]*DeletedMedia, error) {
+	return db.deleteMedias(sq.Expr("hash = any(?)", hashes), false)
+}
+
+// EmptyTrash permanently deletes the media which were moved to the trash before the
+// given time. their files are to be deleted if deleteFiles, or if it was asked for when
+// they were trashed. the hashes of those whose files are kept are remembered, see
+// IsHashPurged
+func (db *DB) EmptyTrash(before time.Time, deleteFiles bool) ([]*DeletedMedia, error) {
+	return db.deleteMedias(sq.Expr("deleted_at <= ?", before), !deleteFiles)
+}
+
+// IsHashPurged finds if a media was deleted from the trash while its files were kept,
+// so that it isn't imported again. media which were uploaded again since aren't purged
+func (db *DB) IsHashPurged(hash string) (bool, error) {
+	q := db.
+		Select().
+		Column(sq.Expr(`exists (select 1 from purged_hashes where hash = ?)
+			and not exists (select 1 from medias where hash = ?)`, hash, hash))
+
+	sql, args, _ := q.ToSql()
+	var result bool
+	return result, pgxscan.Get(context.Background(), db, &result, sql, args...)
+}
+
+// deleteMedias deletes the media matching where. if purge, the hashes of those whose
+// files weren't asked to be deleted when they were trashed are remembered
+func (db *DB) deleteMedias(where sq.Sqlizer, purge bool) ([]*DeletedMedia, error) {
+	deleted := sq.
+		Delete("medias").
+		Where(where).
+		Suffix("returning id, hash, delete_files")
+	colAggFiles := sq.
+		Select("coalesce(json_agg(dir_infos), '[]')").
+		From("dir_infos").
+		Where("dir_infos.media_id = deleted.id")
+	q := db.
+		Select("deleted.hash", "deleted.delete_files").
+		Column(sq.Alias(colAggFiles, "files")).
+		Prefix("with deleted as (?)", deleted).
+		From("deleted")
+	if purge {
+		purged := sq.
+			Insert("purged_hashes").
+			Columns("hash").
+			Select(sq.Select("hash").From("deleted").Where("not delete_files")).
+			Suffix("on conflict (hash) do nothing")
+		q = q.Prefix(", purged as (?)", purged)
+	}
+
+	sql, args, _ := q.ToSql()
+	var results []*DeletedMedia
+	return results, pgxscan.Select(context.Background(), db, &results, sql, args...)
+}
+
+// GetMediaByHashWithRelations finds a media along with its blocks and other relations,
+// and whether user has starred it
+func (db *DB) GetMediaByHashWithRelations(hash string, user UserID) (*Media, error) {
 	colAggBlocks := db.
 		Select("json_agg(blocks order by index)").
 		From("blocks").
@@ -165,95 +423,1433 @@ func (db *DB) GetMediaByHashWithRelations(hash string) (*Media, error) {
 		Select("json_agg(distinct dir_infos.directory_alias)").
 		From("dir_infos").
 		Where("media_id = medias.id")
+	colAggTags := db.
+		Select("json_agg(tags.name order by tags.name)").
+		From("media_tags").
+		Join("tags on tags.id = media_tags.tag_id").
+		Where("media_tags.media_id = medias.id")
+	colAggPalette := db.
+		Select("json_agg(colours order by index)").
+		From("colours").
+		Where("media_id = medias.id")
+
+	q := db.
+		Select("medias.*").
+		Column(sq.Alias(colAggBlocks, "blocks")).
+		Column(sq.Alias(colAggAliases, "directories")).
+		Column(sq.Alias(colAggPalette, "palette")).
+		Column(sq.Alias(colAggTags, "tags")).
+		Column(sq.Alias(starredCond(user), "starred")).
+		Column(sq.Alias(publicExpr, "public")).
+		From("medias").
+		Where(sq.Eq{"hash": hash}).
+		Limit(1)
+
+	sql, args, _ := q.ToSql()
+	var result Media
+	return &result, pgxscan.Get(context.Background(), db, &result, sql, args...)
+}
+
+var ErrCursorWithOffset = errors.New("cursor can't be used with an offset")
+
+func (db *DB) SearchMedias(options SearchMediasOptions) ([]*Media, error) {
+	if options.After != nil && options.Offset != 0 {
+		return nil, ErrCursorWithOffset
+	}
+	if !isSortField(options.SortField) {
+		return nil, fmt.Errorf("invalid sort field %q provided", options.SortField)
+	}
+	if !isSortOrder(options.SortOrder) {
+		return nil, fmt.Errorf("invalid sort order %q provided", options.SortOrder)
+	}
+	search, err := db.newSearch(options)
+	if err != nil {
+		return nil, err
+	}
+	if (options.SortField == SortFieldRank && search.match != MatchModeFullText) ||
+		(options.SortField == SortFieldSimilarity && search.match == MatchModeFullText) {
+		return nil, fmt.Errorf("sort field %q can't be used with match mode %q", options.SortField, search.match)
+	}
+	if options.SortField == SortFieldColour && options.Colour == nil {
+		return nil, fmt.Errorf("sort field %q needs a colour", options.SortField)
+	}
+	if options.SortField == SortFieldPosition && options.Collection == 0 {
+		return nil, fmt.Errorf("sort field %q needs a collection", options.SortField)
+	}
+
+	if options.After != nil && (options.After.SortField != options.SortField || options.After.SortOrder != options.SortOrder ||
+		options.After.StarredFirst != options.StarredFirst) {
+		return nil, fmt.Errorf("cursor is for sort %q %q", options.After.SortField, options.After.SortOrder)
+	}
+
+	starred := starredCond(options.User)
+	q := search.filter.
+		Columns("medias.*").
+		Column(sq.Alias(starred, "starred")).
+		Limit(uint64(options.Limit)).
+		Offset(uint64(options.Offset))
+
+	// the keyset condition is found by the sort field's column below
+	var keyset sq.Sqlizer
+	if options.After != nil && options.SortField == SortFieldTimestamp {
+		keyset = keysetCond(options.After, sq.Expr("medias.timestamp"), options.After.Timestamp)
+	}
+	if options.Collection != 0 {
+		colPosition := sq.Expr("(select position from collection_medias where collection_id = ? and media_id = medias.id)", options.Collection)
+		q = q.Column(sq.Alias(colPosition, "position"))
+		if options.After != nil && options.SortField == SortFieldPosition {
+			keyset = keysetCond(options.After, colPosition, int(options.After.Score))
+		}
+	}
+	if options.Colour != nil {
+		colColourDistance := sq.Expr("(select min(?) from colours where colours.media_id = medias.id)", labDistance(options.Colour))
+		q = q.Column(sq.Alias(colColourDistance, "colour_distance"))
+		if options.After != nil && options.SortField == SortFieldColour {
+			keyset = keysetCond(options.After, colColourDistance, options.After.Score)
+		}
+	}
+	if search.tsQuery != nil {
+		colRank := sq.Expr("ts_rank(text_searches.document, ?)", search.tsQuery)
+		colHeadline := sq.Expr("ts_headline(?::regconfig, (?), ?)", db.textSearchConfig, mediaBodyExpr(), search.tsQuery)
+		q = q.
+			Column(sq.Alias(colRank, "rank")).
+			Column(sq.Alias(colHeadline, "headline"))
+		if options.After != nil && options.SortField == SortFieldRank {
+			keyset = keysetCond(options.After, colRank, options.After.Score)
+		}
+	}
+
+	// join the blocks which match any of the positive text terms so that they can
+	// be highlighted and used for ranking
+	var highlight highlighter
+	if texts := queryMatchTexts(search.query); len(texts) > 0 {
+		highlight = newHighlighter(texts, search.match)
+
+		var joinMatches sq.Or
+		var similarityBody []string
+		for _, text := range texts {
+			joinMatches = append(joinMatches, textMatch("blocks.body", text, search.match))
+			similarityBody = append(similarityBody, text.Text)
+		}
+
+		// the join is a left join since media may have matched by their note alone, in
+		// which case they are ranked by that instead
+		colAggBlocks := sq.Expr("json_agg(blocks order by blocks.index) filter (where blocks.id is not null)")
+		colSimilarity := sq.Expr("coalesce(avg(similarity(blocks.body, ?)), similarity(medias.note, ?))", strings.Join(similarityBody, " "), strings.Join(similarityBody, " "))
+		q = q.
+			Column(sq.Alias(colAggBlocks, "highlighted_blocks")).
+			Column(sq.Alias(colSimilarity, "similarity")).
+			JoinClause(sq.Expr("left join blocks on blocks.media_id = medias.id and (?)", joinMatches)).
+			GroupBy("medias.id")
+		if options.After != nil && options.SortField == SortFieldSimilarity {
+			keyset = keysetCond(options.After, colSimilarity, options.After.Score)
+		}
+	}
+
+	// media id breaks ties so that there's a stable order to page through. when
+	// starred media come first, a page after a starred media continues through the
+	// starred media and then all of the rest
+	if options.StarredFirst {
+		q = q.OrderBy("starred desc")
+		if keyset != nil && options.After.Starred {
+			keyset = sq.Or{sq.And{starred, keyset}, sq.Expr("not ?", starred)}
+		} else if keyset != nil {
+			keyset = sq.And{sq.Expr("not ?", starred), keyset}
+		}
+	}
+	q = q.OrderBy(
+		fmt.Sprintf("%s %s", options.SortField, options.SortOrder),
+		fmt.Sprintf("medias.id %s", options.SortOrder),
+	)
+	switch {
+	case keyset != nil && options.SortField == SortFieldSimilarity:
+		q = q.Having(keyset)
+	case keyset != nil:
+		q = q.Where(keyset)
+	}
+
+	sql, args, _ := q.ToSql()
+	var results []*Media
+	if err := pgxscan.Select(context.Background(), db, &results, sql, args...); err != nil {
+		return nil, patternError(err)
+	}
+	for _, result := range results {
+		for _, block := range result.HighlightedBlocks {
+			block.Spans = highlight.spans(block.Body)
+		}
+		result.NoteSpans = highlight.spans(result.Note)
+	}
+	return results, nil
+}
+
+var ErrInvalidPattern = errors.New("invalid regular expression")
+
+// patternError finds if a search failed because postgres couldn't compile its regular
+// expression. patterns are only checked by postgres, since go's syntax is different
+func patternError(err error) error {
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && pgErr.Code == "2201B" { // invalid_regular_expression
+		return fmt.Errorf("%w: %s", ErrInvalidPattern, pgErr.Message)
+	}
+	return err
+}
+
+// starredCond matches the media which user has starred
+func starredCond(user UserID) sq.Sqlizer {
+	return sq.Expr("exists (select 1 from media_stars where media_stars.media_id = medias.id and media_stars.user_id = ?)", user)
+}
+
+// keysetCond matches the rows after the cursor, where col is the sort column's expression
+func keysetCond(after *SearchCursor, col sq.Sqlizer, value any) sq.Sqlizer {
+	op := ">"
+	if after.SortOrder == "desc" {
+		op = "<"
+	}
+	return sq.Expr(fmt.Sprintf("(?, medias.id) %s (?, ?)", op), col, value, after.ID)
+}
+
+// SearchMediasFacets counts the results of a search in total, and by some of their
+// properties. the limit, offset, cursor, and sort options are ignored
+func (db *DB) SearchMediasFacets(options SearchMediasOptions) (*SearchFacets, error) {
+	search, err := db.newSearch(options)
+	if err != nil {
+		return nil, err
+	}
+
+	matched := search.filter.
+		Columns("medias.id", "medias.type", "medias.timestamp").
+		PlaceholderFormat(sq.Question)
+	facet := func(from, value, order string) string {
+		return fmt.Sprintf(`(select coalesce(json_agg(f), '[]') from (select %s as value, count(distinct matched.id) as count from %s group by 1 order by %s) f)`, value, from, order)
+	}
+
+	q := db.
+		Select().
+		Prefix("with matched as (?)", matched).
+		Column("(select count(1) from matched) as total").
+		Column(facet("matched join dir_infos on dir_infos.media_id = matched.id", "dir_infos.directory_alias", "count desc, value") + " as directories").
+		Column(facet("matched", "matched.type::text", "count desc, value") + " as types").
+		Column(facet("matched", "to_char(matched.timestamp, 'YYYY-MM')", "value desc") + " as months")
+
+	sql, args, _ := q.ToSql()
+	var result SearchFacets
+	if err := pgxscan.Get(context.Background(), db, &result, sql, args...); err != nil {
+		return nil, patternError(err)
+	}
+	return &result, nil
+}
+
+// search is the validated filters of a search
+type search struct {
+	// filter selects from medias with all of the search's joins and conditions, but
+	// without columns
+	filter sq.SelectBuilder
+	match  MatchMode
+	// query is the parsed body, unless the search is full text
+	query Query
+	// tsQuery is the body as a full text query, if the search is full text
+	tsQuery sq.Sqlizer
+}
+
+func (db *DB) newSearch(options SearchMediasOptions) (*search, error) {
+	if options.Media != "" && !isMediaType(options.Media) {
+		return nil, fmt.Errorf("invalid media type %q provided", options.Media)
+	}
+	if options.Orientation != "" && !isOrientation(options.Orientation) {
+		return nil, fmt.Errorf("invalid orientation %q provided", options.Orientation)
+	}
+	if options.TagsMatch == "" {
+		options.TagsMatch = TagsMatchAny
+	}
+	if !isTagsMatch(options.TagsMatch) {
+		return nil, fmt.Errorf("invalid tags match %q provided", options.TagsMatch)
+	}
+	if options.Match == "" {
+		options.Match = MatchModeFuzzy
+	}
+	if !isMatchMode(options.Match) {
+		return nil, fmt.Errorf("invalid match mode %q provided", options.Match)
+	}
+
+	search := &search{
+		filter: db.Select().From("medias").Where("medias.deleted_at is null"),
+		match:  options.Match,
+	}
+
+	// regular expressions are matched as a whole, since the query syntax would
+	// otherwise mangle their brackets, quotes, and dashes. and full text search
+	// accepts postgres' web search syntax rather than our own query language
+	switch {
+	case options.Body == "":
+	case options.Match == MatchModeFullText:
+		search.tsQuery = sq.Expr("websearch_to_tsquery(?::regconfig, ?)", db.textSearchConfig, options.Body)
+		search.filter = search.filter.
+			Join("text_searches on text_searches.media_id = medias.id").
+			Where(sq.Expr("text_searches.document @@ ?", search.tsQuery))
+	case options.Match == MatchModeRegex:
+		search.query = QueryText{Text: options.Body}
+	default:
+		search.query = ParseQuery(options.Body)
+	}
+
+	if search.query != nil {
+		cond, err := queryCond(search.query, options.Match)
+		if err != nil {
+			return nil, fmt.Errorf("invalid query: %w", err)
+		}
+		search.filter = search.filter.Where(cond)
+	}
+	if options.Directory != "" {
+		cond, _ := queryFieldCond(QueryField{Field: QueryFieldDirectory, Value: options.Directory})
+		search.filter = search.filter.Where(cond)
+	}
+	if options.Media != "" {
+		search.filter = search.filter.Where(sq.Eq{"medias.type": options.Media})
+	}
+	if options.Starred {
+		search.filter = search.filter.Where(starredCond(options.User))
+	}
+	if options.Library != 0 {
+		search.filter = search.filter.Where(sq.Or{sq.Eq{"medias.owner_id": nil}, sq.Eq{"medias.owner_id": options.Library}})
+	}
+	if !options.DateFrom.IsZero() {
+		search.filter = search.filter.Where(sq.GtOrEq{"medias.timestamp": options.DateFrom})
+	}
+	if !options.DateTo.IsZero() {
+		search.filter = search.filter.Where(sq.Lt{"medias.timestamp": options.DateTo})
+	}
+	if options.WidthMin > 0 {
+		search.filter = search.filter.Where(sq.GtOrEq{"medias.dim_width": options.WidthMin})
+	}
+	if options.WidthMax > 0 {
+		search.filter = search.filter.Where(sq.LtOrEq{"medias.dim_width": options.WidthMax})
+	}
+	if options.HeightMin > 0 {
+		search.filter = search.filter.Where(sq.GtOrEq{"medias.dim_height": options.HeightMin})
+	}
+	if options.HeightMax > 0 {
+		search.filter = search.filter.Where(sq.LtOrEq{"medias.dim_height": options.HeightMax})
+	}
+	if options.AspectMin > 0 {
+		search.filter = search.filter.Where(sq.GtOrEq{aspectExpr: options.AspectMin})
+	}
+	if options.AspectMax > 0 {
+		search.filter = search.filter.Where(sq.LtOrEq{aspectExpr: options.AspectMax})
+	}
+	if len(options.Tags) > 0 {
+		tags, err := normaliseTags(options.Tags)
+		if err != nil {
+			return nil, err
+		}
+		search.filter = search.filter.Where(tagsCond(tags, options.TagsMatch))
+	}
+	if options.Collection != 0 {
+		search.filter = search.filter.Where("exists (select 1 from collection_medias where collection_id = ? and media_id = medias.id)", options.Collection)
+	}
+	switch options.Orientation {
+	case OrientationPortrait:
+		search.filter = search.filter.Where(sq.Lt{aspectExpr: 1})
+	case OrientationLandscape:
+		search.filter = search.filter.Where(sq.Gt{aspectExpr: 1})
+	case OrientationSquare:
+		search.filter = search.filter.Where(sq.Eq{aspectExpr: 1})
+	}
+	if options.Colour != nil {
+		distance := options.ColourDistance
+		if distance <= 0 {
+			distance = DefaultColourDistance
+		}
+		// narrow by lightness first so that the index can be used
+		lab := options.Colour
+		search.filter = search.filter.Where(sq.Expr(
+			"exists (select 1 from colours where colours.media_id = medias.id and colours.lab_l between ? and ? and ? <= ?)",
+			lab.L-distance, lab.L+distance, labDistance(lab), distance,
+		))
+	}
+	return search, nil
+}
+
+func tagsCond(tags []string, match TagsMatch) sq.Sqlizer {
+	if match == TagsMatchAll {
+		return sq.Expr(
+			"(select count(1) from media_tags join tags on tags.id = media_tags.tag_id where media_tags.media_id = medias.id and tags.name = any(?)) = ?",
+			tags, len(tags),
+		)
+	}
+	return sq.Expr(
+		"exists (select 1 from media_tags join tags on tags.id = media_tags.tag_id where media_tags.media_id = medias.id and tags.name = any(?))",
+		tags,
+	)
+}
+
+// aspectExpr is the aspect ratio of a media. it must match the expression of the
+// index on medias so that the index can be used
+const aspectExpr = "(medias.dim_width::real / greatest(medias.dim_height, 1))"
+
+// DefaultColourDistance is roughly the distance between two colours which would
+// be given the same name
+const DefaultColourDistance = 20
+
+// labDistance is the CIE76 distance between a row of colours and a colour
+func labDistance(lab *Lab) sq.Sqlizer {
+	return sq.Expr(
+		"sqrt(power(colours.lab_l - ?, 2) + power(colours.lab_a - ?, 2) + power(colours.lab_b - ?, 2))",
+		lab.L, lab.A, lab.B,
+	)
+}
+
+// mediaBodyExpr is all of the text of a media including its note, for full text search
+func mediaBodyExpr() sq.Sqlizer {
+	blocksBody := sq.
+		Select("string_agg(blocks.body, ' ' order by blocks.index)").
+		From("blocks").
+		Where("blocks.media_id = medias.id")
+	return sq.Expr("concat_ws(' ', (?), medias.note)", blocksBody)
+}
+
+// UpdateTextSearch rebuilds the full text search document of a media from its text
+func (db *DB) UpdateTextSearch(id MediaID) error {
+	return db.upsertTextSearches(sq.Eq{"medias.id": id})
+}
+
+// RefreshTextSearches builds the full text search documents of every media that has
+// none, or whose document was built with a different text search config
+func (db *DB) RefreshTextSearches() error {
+	return db.upsertTextSearches(sq.Expr("text_searches.config is distinct from ?::regconfig", db.textSearchConfig))
+}
+
+func (db *DB) upsertTextSearches(where sq.Sqlizer) error {
+	colDocument := sq.Expr("to_tsvector(?::regconfig, (?))", db.textSearchConfig, mediaBodyExpr())
+	sel := sq.
+		Select("medias.id").
+		Column("?::regconfig", db.textSearchConfig).
+		Column(colDocument).
+		From("medias").
+		LeftJoin("text_searches on text_searches.media_id = medias.id").
+		Where(where)
+	q := db.
+		Insert("text_searches").
+		Columns("media_id", "config", "document").
+		Select(sel).
+		Suffix("on conflict (media_id) do update set config = excluded.config, document = excluded.document")
+
+	sql, args, _ := q.ToSql()
+	_, err := db.Exec(context.Background(), sql, args...)
+	return err
+}
+
+// SetMediaNote sets the note of a media, and returns its id
+func (db *DB) SetMediaNote(hash string, note string) (MediaID, error) {
+	q := db.
+		Update("medias").
+		Where(sq.Eq{"hash": hash}).
+		Set("note", note).
+		Suffix("returning id")
+
+	sql, args, _ := q.ToSql()
+	var result MediaID
+	return result, pgxscan.Get(context.Background(), db, &result, sql, args...)
+}
+
+func (db *DB) SetMediaProcessed(id MediaID) error {
+	q := db.
+		Update("medias").
+		Where(sq.Eq{"id": id}).
+		Set("processed", true)
+
+	sql, args, _ := q.ToSql()
+	_, err := db.Exec(context.Background(), sql, args...)
+	return err
+}
+
+func (db *DB) CreateBlocks(blocks []*Block) error {
+	if len(blocks) == 0 {
+		return nil
+	}
+
+	q := db.
+		Insert("blocks").
+		Columns("media_id", "index", "min_x", "min_y", "max_x", "max_y", "body")
+	for _, block := range blocks {
+		q = q.Values(block.MediaID, block.Index, block.MinX, block.MinY, block.MaxX, block.MaxY, block.Body)
+	}
+
+	sql, args, _ := q.ToSql()
+	_, err := db.Exec(context.Background(), sql, args...)
+	return err
+}
+
+var ErrInvalidBlock = errors.New("invalid block")
+
+func validateBlock(block *Block) error {
+	switch {
+	case strings.TrimSpace(block.Body) == "":
+		return fmt.Errorf("%w: empty body", ErrInvalidBlock)
+	case block.MinX < 0, block.MinY < 0, block.MaxX <= block.MinX, block.MaxY <= block.MinY:
+		return fmt.Errorf("%w: bad bounding box", ErrInvalidBlock)
+	}
+	return nil
+}
+
+// CreateManualBlock adds a block by hand to the end of a media's blocks
+func (db *DB) CreateManualBlock(hash string, block *Block) (*Block, error) {
+	if err := validateBlock(block); err != nil {
+		return nil, err
+	}
+
+	q := db.
+		Insert("blocks").
+		Columns("media_id", "index", "min_x", "min_y", "max_x", "max_y", "body", "manual").
+		Select(sq.
+			Select("medias.id").
+			Column("(select coalesce(max(index) + 1, 0) from blocks where media_id = medias.id)").
+			Column("?::int", block.MinX).
+			Column("?::int", block.MinY).
+			Column("?::int", block.MaxX).
+			Column("?::int", block.MaxY).
+			Column("?::text", block.Body).
+			Column("true").
+			From("medias").
+			Where(sq.Eq{"medias.hash": hash})).
+		Suffix("returning *")
+
+	sql, args, _ := q.ToSql()
+	var result Block
+	return &result, pgxscan.Get(context.Background(), db, &result, sql, args...)
+}
+
+// UpdateManualBlock corrects the body and box of one of a media's blocks, marking it
+// as manual so that it is kept when the media is reprocessed
+func (db *DB) UpdateManualBlock(hash string, block *Block) (*Block, error) {
+	if err := validateBlock(block); err != nil {
+		return nil, err
+	}
+
+	q := db.
+		Update("blocks").
+		Set("min_x", block.MinX).
+		Set("min_y", block.MinY).
+		Set("max_x", block.MaxX).
+		Set("max_y", block.MaxY).
+		Set("body", block.Body).
+		Set("manual", true).
+		Where(sq.Eq{"id": block.ID}).
+		Where("media_id = (select id from medias where hash = ?)", hash).
+		Suffix("returning *")
+
+	sql, args, _ := q.ToSql()
+	var result Block
+	return &result, pgxscan.Get(context.Background(), db, &result, sql, args...)
+}
+
+// DeleteManualBlock deletes one of a media's blocks, returning the media's id. if the
+// block came from OCR its box is remembered so that it isn't found again when the
+// media is reprocessed
+func (db *DB) DeleteManualBlock(hash string, id BlockID) (MediaID, error) {
+	deleted := sq.
+		Delete("blocks").
+		Where(sq.Eq{"id": id}).
+		Where("media_id = (select id from medias where hash = ?)", hash).
+		Suffix("returning *")
+	removal := sq.
+		Insert("block_removals").
+		Columns("media_id", "min_x", "min_y", "max_x", "max_y").
+		Select(sq.
+			Select("media_id", "min_x", "min_y", "max_x", "max_y").
+			From("deleted").
+			Where("not manual"))
+	q := db.
+		Select("media_id").
+		Prefix("with deleted as (?), removal as (?)", deleted, removal).
+		From("deleted")
+
+	sql, args, _ := q.ToSql()
+	var result MediaID
+	return result, pgxscan.Get(context.Background(), db, &result, sql, args...)
+}
+
+func (db *DB) GetManualBlocks(id MediaID) ([]*Block, error) {
+	q := db.
+		Select("*").
+		From("blocks").
+		Where(sq.Eq{"media_id": id, "manual": true}).
+		OrderBy("index")
+
+	sql, args, _ := q.ToSql()
+	var results []*Block
+	return results, pgxscan.Select(context.Background(), db, &results, sql, args...)
+}
+
+func (db *DB) GetBlockRemovals(id MediaID) ([]*BlockRemoval, error) {
+	q := db.
+		Select("*").
+		From("block_removals").
+		Where(sq.Eq{"media_id": id})
+
+	sql, args, _ := q.ToSql()
+	var results []*BlockRemoval
+	return results, pgxscan.Select(context.Background(), db, &results, sql, args...)
+}
+
+// ReplaceBlocks replaces the blocks of a media which came from OCR. manual blocks
+// are kept
+func (db *DB) ReplaceBlocks(id MediaID, blocks []*Block) error {
+	qs := []sq.Sqlizer{
+		db.Delete("blocks").Where(sq.Eq{"media_id": id, "manual": false}),
+	}
+	if len(blocks) > 0 {
+		insert := db.
+			Insert("blocks").
+			Columns("media_id", "index", "min_x", "min_y", "max_x", "max_y", "body")
+		for _, block := range blocks {
+			insert = insert.Values(block.MediaID, block.Index, block.MinX, block.MinY, block.MaxX, block.MaxY, block.Body)
+		}
+		qs = append(qs, insert)
+	}
+	return db.execTx(qs...)
+}
+
+func (db *DB) selectShares() sq.SelectBuilder {
+	return db.
+		Select("shares.*", "medias.hash as media_hash", "shares.password_hash is not null as has_password").
+		From("shares").
+		Join("medias on medias.id = shares.media_id")
+}
+
+// GetShares finds the shares of a media, or of every media if hash is empty. if owner
+// isn't 0, only the shares of their media are found
+func (db *DB) GetShares(hash string, owner UserID) ([]*Share, error) {
+	q := db.
+		selectShares().
+		OrderBy("shares.created desc", "shares.id desc")
+	if hash != "" {
+		q = q.Where(sq.Eq{"medias.hash": hash})
+	}
+	if owner != 0 {
+		q = q.Where(sq.Eq{"medias.owner_id": owner})
+	}
+
+	sql, args, _ := q.ToSql()
+	var results []*Share
+	return results, pgxscan.Select(context.Background(), db, &results, sql, args...)
+}
+
+// GetShareByToken finds a share which hasn't expired, of a media which isn't in the
+// trash. views aren't checked, see ViewShare
+func (db *DB) GetShareByToken(token string) (*Share, error) {
+	q := db.
+		selectShares().
+		Where(sq.Eq{"shares.token": token}).
+		Where("shares.expires is null or shares.expires > now()").
+		Where("medias.deleted_at is null")
+
+	sql, args, _ := q.ToSql()
+	var result Share
+	return &result, pgxscan.Get(context.Background(), db, &result, sql, args...)
+}
+
+func (db *DB) CreateShare(hash string, share *Share) (*Share, error) {
+	q := db.
+		Insert("shares").
+		Columns("token", "media_id", "expires", "max_views", "password_hash").
+		Select(sq.
+			Select().
+			Column("?::text", share.Token).
+			Column("medias.id").
+			Column("?::timestamptz", share.Expires).
+			Column("?::int", share.MaxViews).
+			Column("?::text", share.PasswordHash).
+			From("medias").
+			Where(sq.Eq{"medias.hash": hash}).
+			Where("medias.deleted_at is null")).
+		Suffix("returning id")
+
+	sql, args, _ := q.ToSql()
+	var id ShareID
+	if err := pgxscan.Get(context.Background(), db, &id, sql, args...); err != nil {
+		return nil, err
+	}
+	return db.GetShareByToken(share.Token)
+}
+
+// ViewShare counts a view of a share, or returns pgx.ErrNoRows if it has been viewed
+// as many times as it's allowed
+func (db *DB) ViewShare(id ShareID) error {
+	q := db.
+		Update("shares").
+		Set("views", sq.Expr("views + 1")).
+		Set("last_viewed", sq.Expr("now()")).
+		Where(sq.Eq{"id": id}).
+		Where("max_views is null or views < max_views").
+		Suffix("returning id")
+
+	sql, args, _ := q.ToSql()
+	return pgxscan.Get(context.Background(), db, &id, sql, args...)
+}
+
+// DeleteShare deletes a share. if owner isn't 0, only the shares of their media can be
+// deleted
+func (db *DB) DeleteShare(id ShareID, owner UserID) error {
+	q := db.
+		Delete("shares").
+		Where(sq.Eq{"id": id})
+	if owner != 0 {
+		q = q.Where("exists (select 1 from medias where medias.id = shares.media_id and medias.owner_id = ?)", owner)
+	}
+
+	sql, args, _ := q.ToSql()
+	tag, err := db.Exec(context.Background(), sql, args...)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return pgx.ErrNoRows
+	}
+	return nil
+}
+
+var (
+	ErrInvalidUser      = errors.New("invalid user")
+	ErrUserExists       = errors.New("user already exists")
+	ErrIdentityConflict = errors.New("username belongs to another account")
+)
+
+func (db *DB) GetUsers() ([]*User, error) {
+	q := db.
+		Select("*").
+		From("users").
+		OrderBy("username")
+
+	sql, args, _ := q.ToSql()
+	var results []*User
+	return results, pgxscan.Select(context.Background(), db, &results, sql, args...)
+}
+
+func (db *DB) GetUser(id UserID) (*User, error) {
+	q := db.
+		Select("*").
+		From("users").
+		Where(sq.Eq{"id": id})
+
+	sql, args, _ := q.ToSql()
+	var result User
+	return &result, pgxscan.Get(context.Background(), db, &result, sql, args...)
+}
+
+func (db *DB) GetUserByUsername(username string) (*User, error) {
+	q := db.
+		Select("*").
+		From("users").
+		Where(sq.Eq{"username": username})
+
+	sql, args, _ := q.ToSql()
+	var result User
+	return &result, pgxscan.Get(context.Background(), db, &result, sql, args...)
+}
+
+func (db *DB) CountUsers() (int, error) {
+	q := db.
+		Select("count(1)").
+		From("users")
+
+	sql, args, _ := q.ToSql()
+	var result int
+	return result, pgxscan.Get(context.Background(), db, &result, sql, args...)
+}
+
+func (db *DB) CreateUser(user *User) (*User, error) {
+	user.Username = strings.TrimSpace(user.Username)
+	if user.Username == "" {
+		return nil, fmt.Errorf("%w: needs a username", ErrInvalidUser)
+	}
+	if !isUserRole(user.Role) {
+		return nil, fmt.Errorf("%w: invalid role %q", ErrInvalidUser, user.Role)
+	}
+
+	q := db.
+		Insert("users").
+		Columns("username", "password_hash", "role").
+		Values(user.Username, user.PasswordHash, user.Role).
+		Suffix("on conflict (username) do nothing").
+		Suffix("returning *")
+
+	sql, args, _ := q.ToSql()
+	var result User
+	if err := pgxscan.Get(context.Background(), db, &result, sql, args...); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, fmt.Errorf("%w: %q", ErrUserExists, user.Username)
+		}
+		return nil, err
+	}
+	return &result, nil
+}
+
+// CreateExternalUser creates a member for someone who logs in without a socr password,
+// such as through a proxy or an openid connect issuer. they have no password hash, so
+// they can't log in with a password. existing users are left as they are
+func (db *DB) CreateExternalUser(username string) error {
+	username = strings.TrimSpace(username)
+	if username == "" {
+		return fmt.Errorf("%w: needs a username", ErrInvalidUser)
+	}
+
+	q := db.
+		Insert("users").
+		Columns("username", "password_hash", "role").
+		Values(username, "", UserRoleMember).
+		Suffix("on conflict (username) do nothing")
+
+	sql, args, _ := q.ToSql()
+	_, err := db.Exec(context.Background(), sql, args...)
+	return err
+}
+
+// GetIdentityUser finds the user who logs in as subject with an openid connect issuer.
+// the first time a subject logs in, it's linked to the user with username if they have
+// no password and aren't linked to the issuer yet, or to a new member if create is set.
+// users with passwords are never linked, see ErrIdentityConflict
+func (db *DB) GetIdentityUser(issuer, subject, username string, create bool) (*User, error) {
+	ctx := context.Background()
+	var result User
+	err := db.BeginFunc(ctx, func(tx pgx.Tx) error {
+		qLinked := db.
+			Select("users.*").
+			From("users").
+			Join("user_identities on user_identities.user_id = users.id").
+			Where(sq.Eq{"user_identities.issuer": issuer, "user_identities.subject": subject})
+		sql, args, _ := qLinked.ToSql()
+		err := pgxscan.Get(ctx, tx, &result, sql, args...)
+		if err == nil || !errors.Is(err, pgx.ErrNoRows) {
+			return err
+		}
+
+		qUser := db.
+			Select("*").
+			From("users").
+			Where(sq.Eq{"username": username}).
+			Suffix("for update")
+		sql, args, _ = qUser.ToSql()
+		err = pgxscan.Get(ctx, tx, &result, sql, args...)
+		switch {
+		case errors.Is(err, pgx.ErrNoRows) && create:
+			qCreate := db.
+				Insert("users").
+				Columns("username", "password_hash", "role").
+				Values(username, "", UserRoleMember).
+				Suffix("returning *")
+			sql, args, _ = qCreate.ToSql()
+			if err := pgxscan.Get(ctx, tx, &result, sql, args...); err != nil {
+				return fmt.Errorf("creating user: %w", err)
+			}
+		case err != nil:
+			return err
+		case result.PasswordHash != "":
+			return fmt.Errorf("%w: %q has a password", ErrIdentityConflict, username)
+		default:
+			qOther := db.
+				Select("count(1)").
+				From("user_identities").
+				Where(sq.Eq{"user_id": result.ID, "issuer": issuer})
+			sql, args, _ = qOther.ToSql()
+			var others int
+			if err := pgxscan.Get(ctx, tx, &others, sql, args...); err != nil {
+				return fmt.Errorf("counting identities: %w", err)
+			}
+			if others > 0 {
+				return fmt.Errorf("%w: %q is linked to another subject", ErrIdentityConflict, username)
+			}
+		}
+
+		qLink := db.
+			Insert("user_identities").
+			Columns("issuer", "subject", "user_id").
+			Values(issuer, subject, result.ID)
+		sql, args, _ = qLink.ToSql()
+		_, err = tx.Exec(ctx, sql, args...)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// CreateFirstAdmin creates an admin if there are no users yet. stars from before
+// there were users are given to them
+func (db *DB) CreateFirstAdmin(username, passwordHash string) (*User, error) {
+	user, err := db.CreateUser(&User{Username: username, PasswordHash: passwordHash, Role: UserRoleAdmin})
+	if err != nil {
+		return nil, err
+	}
+	q := db.
+		Update("media_stars").
+		Set("user_id", user.ID).
+		Where(sq.Eq{"user_id": nil})
+
+	sql, args, _ := q.ToSql()
+	_, err = db.Exec(context.Background(), sql, args...)
+	return user, err
+}
+
+// UpdateUser sets the role and password hash of a user, leaving either unchanged if
+// empty
+func (db *DB) UpdateUser(id UserID, role UserRole, passwordHash string) error {
+	if role != "" && !isUserRole(role) {
+		return fmt.Errorf("%w: invalid role %q", ErrInvalidUser, role)
+	}
+
+	q := db.
+		Update("users").
+		Set("role", sq.Expr("coalesce(nullif(?, '')::user_role, role)", role)).
+		Set("password_hash", sq.Expr("coalesce(nullif(?, ''), password_hash)", passwordHash)).
+		Where(sq.Eq{"id": id}).
+		Suffix("returning id")
+
+	sql, args, _ := q.ToSql()
+	return pgxscan.Get(context.Background(), db, &id, sql, args...)
+}
+
+func (db *DB) DeleteUser(id UserID) error {
+	q := db.
+		Delete("users").
+		Where(sq.Eq{"id": id}).
+		Suffix("returning id")
+
+	sql, args, _ := q.ToSql()
+	return pgxscan.Get(context.Background(), db, &id, sql, args...)
+}
+
+// CreateSession starts a session for a user, which can be refreshed with the token of
+// tokenHash until expires. expired sessions are cleaned up too
+func (db *DB) CreateSession(user UserID, tokenHash string, expires time.Time) (*Session, error) {
+	qClean := db.
+		Delete("sessions").
+		Where("expires <= now()")
+
+	sql, args, _ := qClean.ToSql()
+	if _, err := db.Exec(context.Background(), sql, args...); err != nil {
+		return nil, fmt.Errorf("cleaning sessions: %w", err)
+	}
+
+	q := db.
+		Insert("sessions").
+		Columns("user_id", "token_hash", "expires").
+		Values(user, tokenHash, expires).
+		Suffix("returning *")
+
+	sql, args, _ = q.ToSql()
+	var result Session
+	return &result, pgxscan.Get(context.Background(), db, &result, sql, args...)
+}
+
+// RefreshSession swaps the token of a session which hasn't expired for a new one, so
+// that each refresh token can only be used once
+func (db *DB) RefreshSession(tokenHash, newTokenHash string, expires time.Time) (*Session, error) {
+	q := db.
+		Update("sessions").
+		Set("token_hash", newTokenHash).
+		Set("expires", expires).
+		Set("last_used", sq.Expr("now()")).
+		Where(sq.Eq{"token_hash": tokenHash}).
+		Where("expires > now()").
+		Suffix("returning *")
+
+	sql, args, _ := q.ToSql()
+	var result Session
+	return &result, pgxscan.Get(context.Background(), db, &result, sql, args...)
+}
 
+func (db *DB) DeleteSession(user UserID, tokenHash string) error {
 	q := db.
-		Select("medias.*").
-		Column(sq.Alias(colAggBlocks, "blocks")).
-		Column(sq.Alias(colAggAliases, "directories")).
-		From("medias").
-		Where(sq.Eq{"hash": hash}).
-		Limit(1)
+		Delete("sessions").
+		Where(sq.Eq{"user_id": user, "token_hash": tokenHash})
 
 	sql, args, _ := q.ToSql()
-	var result Media
-	return &result, pgxscan.Get(context.Background(), db, &result, sql, args...)
+	_, err := db.Exec(context.Background(), sql, args...)
+	return err
 }
 
-func (db *DB) SearchMedias(options SearchMediasOptions) ([]*Media, error) {
-	if !isSortField(options.SortField) {
-		return nil, fmt.Errorf("invalid sort field %q provided", options.SortField)
+// RevokeToken revokes an access token by its jti until it expires. tokens which have
+// expired anyway are cleaned up too
+func (db *DB) RevokeToken(jti string, expires time.Time) error {
+	qClean := db.
+		Delete("revoked_tokens").
+		Where("expires <= now()")
+	qRevoke := db.
+		Insert("revoked_tokens").
+		Columns("jti", "expires").
+		Values(jti, expires).
+		Suffix("on conflict (jti) do nothing")
+	return db.execTx(qClean, qRevoke)
+}
+
+// RevokeUserTokens ends every session of a user, and revokes every access token they
+// have been issued up to at
+func (db *DB) RevokeUserTokens(user UserID, at time.Time) error {
+	qSessions := db.
+		Delete("sessions").
+		Where(sq.Eq{"user_id": user})
+	// tokens issued at or before at are revoked. at is from the same clock as tokens'
+	// issued at, which is kept to the microsecond, see auth.Claims
+	qUser := db.
+		Update("users").
+		Set("tokens_revoked_at", at).
+		Where(sq.Eq{"id": user})
+	return db.execTx(qSessions, qUser)
+}
+
+// IsTokenValid checks that an access token hasn't been revoked, and that its user
+// still exists
+func (db *DB) IsTokenValid(jti string, user UserID, issuedAt time.Time) (bool, error) {
+	qRevoked := sq.
+		Select("1").
+		From("revoked_tokens").
+		Where(sq.Eq{"jti": jti})
+	qUser := sq.
+		Select("1").
+		From("users").
+		Where(sq.Eq{"id": user}).
+		Where(sq.Or{
+			sq.Eq{"tokens_revoked_at": nil},
+			sq.Lt{"tokens_revoked_at": issuedAt},
+		})
+	q := db.
+		Select().
+		Column(sq.Expr("not exists (?) and exists (?)", qRevoked, qUser))
+
+	sql, args, _ := q.ToSql()
+	var result bool
+	return result, pgxscan.Get(context.Background(), db, &result, sql, args...)
+}
+
+var ErrInvalidAPIKey = errors.New("invalid api key")
+
+// GetAPIKeys finds the api keys of a user, or of everyone if user is 0
+func (db *DB) GetAPIKeys(user UserID) ([]*APIKey, error) {
+	q := db.
+		Select("*").
+		From("api_keys").
+		OrderBy("created desc", "id desc")
+	if user != 0 {
+		q = q.Where(sq.Eq{"user_id": user})
 	}
-	if !isSortOrder(options.SortOrder) {
-		return nil, fmt.Errorf("invalid sort order %q provided", options.SortOrder)
+
+	sql, args, _ := q.ToSql()
+	var results []*APIKey
+	return results, pgxscan.Select(context.Background(), db, &results, sql, args...)
+}
+
+func (db *DB) CreateAPIKey(key *APIKey) (*APIKey, error) {
+	key.Name = strings.TrimSpace(key.Name)
+	if key.Name == "" {
+		return nil, fmt.Errorf("%w: needs a name", ErrInvalidAPIKey)
 	}
-	if options.Media != "" && !isMediaType(options.Media) {
-		return nil, fmt.Errorf("invalid media type %q provided", options.Media)
+	if !isAPIKeyScope(key.Scope) {
+		return nil, fmt.Errorf("%w: invalid scope %q", ErrInvalidAPIKey, key.Scope)
 	}
 
 	q := db.
-		Select("medias.*").
-		From("medias").
-		Limit(uint64(options.Limit)).
-		Offset(uint64(options.Offset)).
-		OrderBy(fmt.Sprintf("%s %s", options.SortField, options.SortOrder))
-	if options.Directory != "" {
-		q = q.
-			Join("dir_infos on dir_infos.media_id = medias.id").
-			Where(sq.Eq{"dir_infos.directory_alias": options.Directory})
+		Insert("api_keys").
+		Columns("name", "key_hash", "scope", "user_id").
+		Values(key.Name, key.KeyHash, key.Scope, key.UserID).
+		Suffix("returning *")
+
+	sql, args, _ := q.ToSql()
+	var result APIKey
+	return &result, pgxscan.Get(context.Background(), db, &result, sql, args...)
+}
+
+// SetEnvAPIKey replaces the key from the SOCR_API_KEY env var, which has no user and
+// may only upload. an empty hash removes it
+func (db *DB) SetEnvAPIKey(keyHash string) error {
+	qDelete := db.
+		Delete("api_keys").
+		Where(sq.Eq{"user_id": nil}).
+		Where(sq.NotEq{"key_hash": keyHash})
+	if keyHash == "" {
+		return db.execTx(qDelete)
 	}
-	if options.Body != "" {
-		colAggBlocks := sq.Expr("json_agg(blocks order by blocks.index)")
-		colSimilarity := sq.Expr("avg(similarity(blocks.body, ?))", options.Body)
-		q = q.
-			Column(sq.Alias(colAggBlocks, "highlighted_blocks")).
-			Column(sq.Alias(colSimilarity, "similarity")).
-			LeftJoin("blocks on blocks.media_id = medias.id").
-			Where("blocks.body %> ?", options.Body).
-			GroupBy("medias.id")
+	qInsert := db.
+		Insert("api_keys").
+		Columns("name", "key_hash", "scope").
+		Values("SOCR_API_KEY", keyHash, APIKeyScopeUpload).
+		Suffix("on conflict (key_hash) do nothing")
+	return db.execTx(qDelete, qInsert)
+}
+
+// UseAPIKey finds an api key by its hash, and sets when it was last used
+func (db *DB) UseAPIKey(keyHash string) (*APIKey, error) {
+	q := db.
+		Update("api_keys").
+		Set("last_used", sq.Expr("now()")).
+		Where(sq.Eq{"key_hash": keyHash}).
+		Suffix("returning *")
+
+	sql, args, _ := q.ToSql()
+	var result APIKey
+	return &result, pgxscan.Get(context.Background(), db, &result, sql, args...)
+}
+
+// DeleteAPIKey revokes an api key of a user, or of anyone if user is 0
+func (db *DB) DeleteAPIKey(id APIKeyID, user UserID) error {
+	q := db.
+		Delete("api_keys").
+		Where(sq.Eq{"id": id}).
+		Suffix("returning id")
+	if user != 0 {
+		q = q.Where(sq.Eq{"user_id": user})
 	}
-	if options.Media != "" {
-		q = q.Where(sq.Eq{"medias.type": options.Media})
+
+	sql, args, _ := q.ToSql()
+	return pgxscan.Get(context.Background(), db, &id, sql, args...)
+}
+
+func (db *DB) CreateColours(colours []*Colour) error {
+	if len(colours) == 0 {
+		return nil
 	}
-	if !options.DateFrom.IsZero() {
-		q = q.Where(sq.GtOrEq{"medias.timestamp": options.DateFrom})
+
+	q := db.
+		Insert("colours").
+		Columns("media_id", "index", "hex", "weight", "lab_l", "lab_a", "lab_b").
+		Suffix("on conflict do nothing")
+	for _, colour := range colours {
+		q = q.Values(colour.MediaID, colour.Index, colour.Hex, colour.Weight, colour.LabL, colour.LabA, colour.LabB)
 	}
-	if !options.DateTo.IsZero() {
-		q = q.Where(sq.Lt{"medias.timestamp": options.DateTo})
+
+	sql, args, _ := q.ToSql()
+	_, err := db.Exec(context.Background(), sql, args...)
+	return err
+}
+
+// GetThumbnailsWithoutColours finds thumbnails for media which were imported before
+// colours were stored, so that their colours can be found
+func (db *DB) GetThumbnailsWithoutColours(after MediaID, limit int) ([]*Thumbnail, error) {
+	q := db.
+		Select("thumbnails.*").
+		From("thumbnails").
+		Where(sq.Gt{"thumbnails.media_id": after}).
+		Where("not exists (select 1 from colours where colours.media_id = thumbnails.media_id)").
+		OrderBy("thumbnails.media_id").
+		Limit(uint64(limit))
+
+	sql, args, _ := q.ToSql()
+	var result []*Thumbnail
+	return result, pgxscan.Select(context.Background(), db, &result, sql, args...)
+}
+
+// GetTags finds every tag, with how many media in library have it. see
+// SearchMediasOptions.Library
+func (db *DB) GetTags(library UserID) ([]*TagCount, error) {
+	counted := sq.And{sq.Expr("medias.id = media_tags.media_id"), sq.Eq{"medias.deleted_at": nil}}
+	if library != 0 {
+		counted = append(counted, sq.Or{sq.Eq{"medias.owner_id": nil}, sq.Eq{"medias.owner_id": library}})
 	}
+	q := db.
+		Select("tags.name", "count(media_tags.media_id) as count").
+		From("tags").
+		JoinClause(sq.Expr("left join media_tags on media_tags.tag_id = tags.id and exists (?)", sq.Select("1").From("medias").Where(counted))).
+		GroupBy("tags.id").
+		OrderBy("tags.name")
 
 	sql, args, _ := q.ToSql()
-	var results []*Media
-	return results, pgxscan.Select(context.Background(), db, &results, sql, args...)
+	var result []*TagCount
+	return result, pgxscan.Select(context.Background(), db, &result, sql, args...)
 }
 
-func (db *DB) SetMediaProcessed(id MediaID) error {
+// AddMediaTags tags each media with each tag, creating the tags if needed
+func (db *DB) AddMediaTags(hashes []string, tags []string) error {
+	tags, err := normaliseTags(tags)
+	if err != nil {
+		return err
+	}
+
+	qTags := db.
+		Insert("tags").
+		Columns("name").
+		Select(sq.Select().Column("unnest(?::text[])", tags)).
+		Suffix("on conflict do nothing")
+	qMediaTags := db.
+		Insert("media_tags").
+		Columns("media_id", "tag_id").
+		Select(sq.
+			Select("medias.id", "tags.id").
+			From("medias").
+			Join("tags on tags.name = any(?)", tags).
+			Where("medias.hash = any(?)", hashes)).
+		Suffix("on conflict do nothing")
+
+	return db.execTx(qTags, qMediaTags)
+}
+
+// RemoveMediaTags untags each media from each tag, deleting tags which are left
+// with no media
+func (db *DB) RemoveMediaTags(hashes []string, tags []string) error {
+	tags, err := normaliseTags(tags)
+	if err != nil {
+		return err
+	}
+
+	qMediaTags := db.
+		Delete("media_tags").
+		Where("media_id in (select id from medias where hash = any(?))", hashes).
+		Where("tag_id in (select id from tags where name = any(?))", tags)
+	qTags := db.
+		Delete("tags").
+		Where("name = any(?)", tags).
+		Where("not exists (select 1 from media_tags where media_tags.tag_id = tags.id)")
+
+	return db.execTx(qMediaTags, qTags)
+}
+
+// RenameTag renames a tag, merging it into the new tag if that already exists
+func (db *DB) RenameTag(from, to string) error {
+	from, to = NormaliseTag(from), NormaliseTag(to)
+	if from == "" || to == "" {
+		return ErrInvalidTag
+	}
+	if from == to {
+		return nil
+	}
+
+	if _, err := db.GetTag(from); err != nil {
+		return fmt.Errorf("get tag: %w", err)
+	}
+
+	qTo := db.
+		Insert("tags").
+		Columns("name").
+		Values(to).
+		Suffix("on conflict do nothing")
+	qMediaTags := db.
+		Insert("media_tags").
+		Columns("media_id", "tag_id").
+		Select(sq.
+			Select("media_tags.media_id").
+			Column("(select id from tags where name = ?)", to).
+			From("media_tags").
+			Join("tags on tags.id = media_tags.tag_id").
+			Where(sq.Eq{"tags.name": from})).
+		Suffix("on conflict do nothing")
+	qFrom := db.
+		Delete("tags").
+		Where(sq.Eq{"name": from})
+
+	return db.execTx(qTo, qMediaTags, qFrom)
+}
+
+func (db *DB) GetTag(name string) (*Tag, error) {
 	q := db.
-		Update("medias").
-		Where(sq.Eq{"id": id}).
-		Set("processed", true)
+		Select("*").
+		From("tags").
+		Where(sq.Eq{"name": NormaliseTag(name)}).
+		Limit(1)
 
 	sql, args, _ := q.ToSql()
-	_, err := db.Exec(context.Background(), sql, args...)
-	return err
+	var result Tag
+	return &result, pgxscan.Get(context.Background(), db, &result, sql, args...)
 }
 
-func (db *DB) CreateBlocks(blocks []*Block) error {
-	if len(blocks) == 0 {
+// execTx runs each query in order in a single transaction
+func (db *DB) execTx(qs ...sq.Sqlizer) error {
+	return db.BeginFunc(context.Background(), func(tx pgx.Tx) error {
+		for _, q := range qs {
+			sql, args, _ := q.ToSql()
+			if _, err := tx.Exec(context.Background(), sql, args...); err != nil {
+				return err
+			}
+		}
 		return nil
+	})
+}
+
+var ErrInvalidTag = errors.New("invalid tag")
+
+// NormaliseTag trims and lowercases a tag name so that tags are matched
+// regardless of case
+func NormaliseTag(tag string) string {
+	return strings.ToLower(strings.TrimSpace(tag))
+}
+
+func normaliseTags(tags []string) ([]string, error) {
+	normalised := make([]string, 0, len(tags))
+	for _, tag := range tags {
+		tag = NormaliseTag(tag)
+		if tag == "" {
+			return nil, ErrInvalidTag
+		}
+		if !slices.Contains(normalised, tag) {
+			normalised = append(normalised, tag)
+		}
 	}
+	return normalised, nil
+}
+
+var ErrInvalidCollectionName = errors.New("invalid collection name")
 
+func (db *DB) selectCollections() sq.SelectBuilder {
+	colCoverHash := `coalesce(
+		(select hash from medias where id = collections.cover_media_id and deleted_at is null),
+		(select medias.hash from collection_medias join medias on medias.id = collection_medias.media_id
+			where collection_medias.collection_id = collections.id and medias.deleted_at is null order by position, media_id limit 1)
+	) as cover_hash`
+	colCount := `(select count(1) from collection_medias join medias on medias.id = collection_medias.media_id
+		where collection_medias.collection_id = collections.id and medias.deleted_at is null) as count`
+	return db.
+		Select("collections.*", colCoverHash, colCount).
+		From("collections")
+}
+
+// GetCollections finds the collections of owner, or every collection if owner is 0
+func (db *DB) GetCollections(owner UserID) ([]*Collection, error) {
 	q := db.
-		Insert("blocks").
-		Columns("media_id", "index", "min_x", "min_y", "max_x", "max_y", "body")
-	for _, block := range blocks {
-		q = q.Values(block.MediaID, block.Index, block.MinX, block.MinY, block.MaxX, block.MaxY, block.Body)
+		selectCollections().
+		OrderBy("collections.name", "collections.id")
+	if owner != 0 {
+		q = q.Where(sq.Eq{"collections.owner_id": owner})
+	}
+
+	sql, args, _ := q.ToSql()
+	var result []*Collection
+	return result, pgxscan.Select(context.Background(), db, &result, sql, args...)
+}
+
+// GetCollection finds a collection, if it belongs to owner or owner is 0
+func (db *DB) GetCollection(id CollectionID, owner UserID) (*Collection, error) {
+	q := db.
+		selectCollections().
+		Where(sq.Eq{"collections.id": id}).
+		Limit(1)
+	if owner != 0 {
+		q = q.Where(sq.Eq{"collections.owner_id": owner})
+	}
+
+	sql, args, _ := q.ToSql()
+	var result Collection
+	return &result, pgxscan.Get(context.Background(), db, &result, sql, args...)
+}
+
+// CreateCollection creates a collection for owner, with the media of coverHash as its
+// cover if it isn't empty
+func (db *DB) CreateCollection(name string, coverHash string, owner *UserID) (CollectionID, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return 0, ErrInvalidCollectionName
+	}
+
+	q := db.
+		Insert("collections").
+		Columns("name", "cover_media_id", "owner_id").
+		Values(name, coverMediaID(coverHash), owner).
+		Suffix("returning id")
+
+	sql, args, _ := q.ToSql()
+	var result CollectionID
+	return result, pgxscan.Get(context.Background(), db, &result, sql, args...)
+}
+
+// UpdateCollection renames a collection and sets its cover, if it belongs to owner or
+// owner is 0
+func (db *DB) UpdateCollection(id CollectionID, owner UserID, name string, coverHash string) error {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return ErrInvalidCollectionName
 	}
 
+	q := db.
+		Update("collections").
+		Set("name", name).
+		Set("cover_media_id", coverMediaID(coverHash)).
+		Where(sq.Eq{"id": id})
+	if owner != 0 {
+		q = q.Where(sq.Eq{"owner_id": owner})
+	}
+
+	sql, args, _ := q.ToSql()
+	tag, err := db.Exec(context.Background(), sql, args...)
+	if err == nil && tag.RowsAffected() == 0 {
+		return pgx.ErrNoRows
+	}
+	return err
+}
+
+// DeleteCollection deletes a collection, if it belongs to owner or owner is 0
+func (db *DB) DeleteCollection(id CollectionID, owner UserID) error {
+	q := db.
+		Delete("collections").
+		Where(sq.Eq{"id": id})
+	if owner != 0 {
+		q = q.Where(sq.Eq{"owner_id": owner})
+	}
+
+	sql, args, _ := q.ToSql()
+	tag, err := db.Exec(context.Background(), sql, args...)
+	if err == nil && tag.RowsAffected() == 0 {
+		return pgx.ErrNoRows
+	}
+	return err
+}
+
+// AddCollectionMedias appends media to the end of a collection, in the order given.
+// media already in the collection keep their position
+func (db *DB) AddCollectionMedias(id CollectionID, hashes []string) error {
+	colPosition := sq.Expr(
+		"(select coalesce(max(position), -1) from collection_medias where collection_id = ?) + row_number() over (order by array_position(?::text[], medias.hash))",
+		id, hashes,
+	)
+	q := db.
+		Insert("collection_medias").
+		Columns("collection_id", "media_id", "position").
+		Select(sq.
+			Select().
+			Column("?::int", id).
+			Column("medias.id").
+			Column(colPosition).
+			From("medias").
+			Where("medias.hash = any(?)", hashes).
+			Where("not exists (select 1 from collection_medias where collection_id = ? and media_id = medias.id)", id)).
+		Suffix("on conflict do nothing")
+
+	sql, args, _ := q.ToSql()
+	_, err := db.Exec(context.Background(), sql, args...)
+	return err
+}
+
+func (db *DB) RemoveCollectionMedias(id CollectionID, hashes []string) error {
+	q := db.
+		Delete("collection_medias").
+		Where(sq.Eq{"collection_id": id}).
+		Where("media_id in (select id from medias where hash = any(?))", hashes)
+
+	sql, args, _ := q.ToSql()
+	_, err := db.Exec(context.Background(), sql, args...)
+	return err
+}
+
+// ReorderCollectionMedias moves media to the start of a collection, in the order
+// given. the rest of the collection's media follow in their existing order
+func (db *DB) ReorderCollectionMedias(id CollectionID, hashes []string) error {
+	colPosition := sq.Expr(
+		"coalesce(array_position(?::text[], (select hash from medias where id = collection_medias.media_id)) - 1, ? + position)",
+		hashes, len(hashes),
+	)
+	q := db.
+		Update("collection_medias").
+		Set("position", colPosition).
+		Where(sq.Eq{"collection_id": id})
+
 	sql, args, _ := q.ToSql()
 	_, err := db.Exec(context.Background(), sql, args...)
 	return err
 }
 
+func coverMediaID(coverHash string) sq.Sqlizer {
+	if coverHash == "" {
+		return sq.Expr("null")
+	}
+	return sq.Expr("(select id from medias where hash = ?)", coverHash)
+}
+
 func (db *DB) CreateDirInfo(dirInfo *DirInfo) (*DirInfo, error) {
 	q := db.
 		Insert("dir_infos").
@@ -323,20 +1919,30 @@ func (db *DB) GetThumbnailByMediaHash(hash string) (*Thumbnail, error) {
 func (db *DB) CountDirectories() ([]*DirectoryCount, error) {
 	q := db.
 		Select(
-			"directory_alias",
+			"dir_infos.directory_alias",
 			"count(1) as count",
+			"coalesce(directory_visibilities.visibility, 'public') as visibility",
 		).
 		From("dir_infos").
-		GroupBy("directory_alias")
+		LeftJoin("directory_visibilities on directory_visibilities.directory_alias = dir_infos.directory_alias").
+		GroupBy("dir_infos.directory_alias", "directory_visibilities.visibility")
 
 	sql, args, _ := q.ToSql()
 	var result []*DirectoryCount
 	return result, pgxscan.Select(context.Background(), db, &result, sql, args...)
 }
 
+const (
+	SortFieldTimestamp  = "timestamp"
+	SortFieldSimilarity = "similarity"
+	SortFieldRank       = "rank"
+	SortFieldColour     = "colour"
+	SortFieldPosition   = "position"
+)
+
 func isSortField(f string) bool {
 	switch f {
-	case "timestamp", "similarity":
+	case SortFieldTimestamp, SortFieldSimilarity, SortFieldRank, SortFieldColour, SortFieldPosition:
 		return true
 	}
 	return false
@@ -350,6 +1956,56 @@ func isSortOrder(f string) bool {
 	return false
 }
 
+func isMatchMode(f MatchMode) bool {
+	switch f {
+	case MatchModeFuzzy, MatchModeExact, MatchModeInsensitive, MatchModeRegex, MatchModeFullText:
+		return true
+	}
+	return false
+}
+
+var ErrInvalidVisibility = errors.New("invalid visibility")
+
+func isAPIKeyScope(f APIKeyScope) bool {
+	switch f {
+	case APIKeyScopeUpload, APIKeyScopeRead, APIKeyScopeAdmin:
+		return true
+	}
+	return false
+}
+
+func isUserRole(f UserRole) bool {
+	switch f {
+	case UserRoleAdmin, UserRoleMember:
+		return true
+	}
+	return false
+}
+
+func isVisibility(f Visibility) bool {
+	switch f {
+	case VisibilityPublic, VisibilityPrivate:
+		return true
+	}
+	return false
+}
+
+func isOrientation(f Orientation) bool {
+	switch f {
+	case OrientationPortrait, OrientationLandscape, OrientationSquare:
+		return true
+	}
+	return false
+}
+
+func isTagsMatch(f TagsMatch) bool {
+	switch f {
+	case TagsMatchAny, TagsMatchAll:
+		return true
+	}
+	return false
+}
+
 func isMediaType(f MediaType) bool {
 	switch f {
 	case MediaTypeImage, MediaTypeVideo:
@@ -357,3 +2013,96 @@ func isMediaType(f MediaType) bool {
 	}
 	return false
 }
+
+func queryCond(query Query, mode MatchMode) (sq.Sqlizer, error) {
+	switch query := query.(type) {
+	case QueryText:
+		return sq.Or{
+			sq.Expr("exists (select 1 from blocks where blocks.media_id = medias.id and ?)", textMatch("blocks.body", query, mode)),
+			textMatch("medias.note", query, mode),
+		}, nil
+	case QueryField:
+		return queryFieldCond(query)
+	case QueryNot:
+		cond, err := queryCond(query.Query, mode)
+		if err != nil {
+			return nil, err
+		}
+		return sq.Expr("not (?)", cond), nil
+	case QueryAnd:
+		conds := make(sq.And, 0, len(query))
+		for _, q := range query {
+			cond, err := queryCond(q, mode)
+			if err != nil {
+				return nil, err
+			}
+			conds = append(conds, cond)
+		}
+		return conds, nil
+	case QueryOr:
+		conds := make(sq.Or, 0, len(query))
+		for _, q := range query {
+			cond, err := queryCond(q, mode)
+			if err != nil {
+				return nil, err
+			}
+			conds = append(conds, cond)
+		}
+		return conds, nil
+	}
+	return nil, fmt.Errorf("unknown query node %T", query)
+}
+
+func queryFieldCond(field QueryField) (sq.Sqlizer, error) {
+	switch field.Field {
+	case QueryFieldDirectory:
+		return sq.Expr("exists (select 1 from dir_infos where dir_infos.media_id = medias.id and dir_infos.directory_alias = ?)", field.Value), nil
+	case QueryFieldType:
+		if !isMediaType(MediaType(field.Value)) {
+			return nil, fmt.Errorf("invalid media type %q provided", field.Value)
+		}
+		return sq.Eq{"medias.type": field.Value}, nil
+	case QueryFieldTag:
+		return tagsCond([]string{NormaliseTag(field.Value)}, TagsMatchAny), nil
+	}
+	return nil, fmt.Errorf("unknown field %q", field.Field)
+}
+
+// textMatch matches a text column against a text term. all of the operators are
+// supported by the trigram indexes on blocks.body and medias.note
+func textMatch(col string, text QueryText, mode MatchMode) sq.Sqlizer {
+	switch {
+	case mode == MatchModeRegex:
+		return sq.Expr(col+" ~* ?", text.Text)
+	case mode == MatchModeExact:
+		return sq.Expr(col+" like ?", "%"+escapeLike(text.Text)+"%")
+	case mode == MatchModeInsensitive, text.Phrase:
+		return sq.Expr(col+" ilike ?", "%"+escapeLike(text.Text)+"%")
+	}
+	return sq.Expr(col+" %> ?", text.Text)
+}
+
+// queryMatchTexts returns the text terms of a query which are not negated
+func queryMatchTexts(query Query) []QueryText {
+	switch query := query.(type) {
+	case QueryText:
+		return []QueryText{query}
+	case QueryAnd:
+		var texts []QueryText
+		for _, q := range query {
+			texts = append(texts, queryMatchTexts(q)...)
+		}
+		return texts
+	case QueryOr:
+		var texts []QueryText
+		for _, q := range query {
+			texts = append(texts, queryMatchTexts(q)...)
+		}
+		return texts
+	}
+	return nil
+}
+
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
@@ -0,0 +1,70 @@
+package db_test
+
+import (
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"go.senan.xyz/socr/db"
+	"go.senan.xyz/socr/server/auth"
+)
+
+// newTestDB connects to the database of SOCR_TEST_DB_DSN and migrates it, or skips the
+// test if there isn't one
+func newTestDB(t *testing.T) *db.DB {
+	t.Helper()
+	dsn := os.Getenv("SOCR_TEST_DB_DSN")
+	if dsn == "" {
+		t.Skip("no SOCR_TEST_DB_DSN")
+	}
+	dbc, err := db.New(dsn, "simple")
+	if err != nil {
+		t.Fatalf("connecting: %v", err)
+	}
+	t.Cleanup(dbc.Close)
+	if err := dbc.Migrate(); err != nil {
+		t.Fatalf("migrating: %v", err)
+	}
+	return dbc
+}
+
+func TestRevokeUserTokensSameSecond(t *testing.T) {
+	dbc := newTestDB(t)
+	username, _ := auth.RandomToken(8)
+	user, err := dbc.CreateUser(&db.User{Username: "test " + username, Role: db.UserRoleMember})
+	if err != nil {
+		t.Fatalf("creating user: %v", err)
+	}
+	subject := strconv.Itoa(int(user.ID))
+
+	// a token issued before the revocation, and one issued after, all in one second
+	second := time.Now().Truncate(time.Second)
+	before, _ := auth.TokenNew("secret", subject, second.Add(100*time.Millisecond))
+	if err := dbc.RevokeUserTokens(user.ID, second.Add(200*time.Millisecond)); err != nil {
+		t.Fatalf("revoking tokens: %v", err)
+	}
+	after, _ := auth.TokenNew("secret", subject, second.Add(300*time.Millisecond))
+
+	tcases := []struct {
+		name  string
+		token string
+		valid bool
+	}{
+		{name: "before", token: before, valid: false},
+		{name: "after", token: after, valid: true},
+	}
+	for _, tcase := range tcases {
+		claims, err := auth.TokenParse("secret", tcase.token)
+		if err != nil {
+			t.Fatalf("parsing token %s: %v", tcase.name, err)
+		}
+		valid, err := dbc.IsTokenValid(claims.ID, user.ID, claims.Issued())
+		if err != nil {
+			t.Fatalf("checking token %s: %v", tcase.name, err)
+		}
+		if valid != tcase.valid {
+			t.Errorf("token issued %s revocation valid %t expected %t", tcase.name, valid, tcase.valid)
+		}
+	}
+}
@@ -0,0 +1,7 @@
+create table text_searches (
+    media_id integer primary key references medias (id) on delete cascade,
+    config regconfig not null,
+    document tsvector not null
+);
+
+create index idx_text_searches_document on text_searches using gin (document);
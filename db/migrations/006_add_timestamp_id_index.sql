@@ -0,0 +1,3 @@
+drop index idx_medias_timestamp;
+
+create index idx_medias_timestamp_id on medias (timestamp, id);
@@ -0,0 +1,12 @@
+create table colours (
+    media_id integer not null references medias (id) on delete cascade,
+    index int not null,
+    hex text not null,
+    weight real not null,
+    lab_l real not null,
+    lab_a real not null,
+    lab_b real not null,
+    primary key (media_id, index)
+);
+
+create index idx_colours_lab on colours (lab_l, lab_a, lab_b);
@@ -0,0 +1,5 @@
+create index idx_medias_dim_width on medias (dim_width);
+
+create index idx_medias_dim_height on medias (dim_height);
+
+create index idx_medias_aspect_ratio on medias ((dim_width::real / greatest(dim_height, 1)));
@@ -0,0 +1,14 @@
+create table tags (
+    id serial primary key,
+    name text not null
+);
+
+create unique index idx_tags_name on tags (name);
+
+create table media_tags (
+    media_id integer not null references medias (id) on delete cascade,
+    tag_id integer not null references tags (id) on delete cascade,
+    primary key (media_id, tag_id)
+);
+
+create index idx_media_tags_tag_id on media_tags (tag_id);
@@ -0,0 +1,17 @@
+create table collections (
+    id serial primary key,
+    name text not null,
+    cover_media_id integer references medias (id) on delete set null,
+    created timestamptz not null default now()
+);
+
+create table collection_medias (
+    collection_id integer not null references collections (id) on delete cascade,
+    media_id integer not null references medias (id) on delete cascade,
+    position int not null,
+    primary key (collection_id, media_id)
+);
+
+create index idx_collection_medias_media_id on collection_medias (media_id);
+
+create index idx_collection_medias_position on collection_medias (collection_id, position);
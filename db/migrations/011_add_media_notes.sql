@@ -0,0 +1,4 @@
+alter table medias
+    add column note text not null default '';
+
+create index idx_medias_note on medias using gin (note gin_trgm_ops);
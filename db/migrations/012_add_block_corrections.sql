@@ -0,0 +1,13 @@
+alter table blocks
+    add column manual boolean not null default false;
+
+create table block_removals (
+    id serial primary key,
+    media_id integer not null references medias (id) on delete cascade,
+    min_x int not null,
+    min_y int not null,
+    max_x int not null,
+    max_y int not null
+);
+
+create index idx_block_removals_media_id on block_removals (media_id);
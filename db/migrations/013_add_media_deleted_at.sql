@@ -0,0 +1,6 @@
+alter table medias
+    add column deleted_at timestamptz;
+
+create index idx_medias_deleted_at on medias (deleted_at)
+where
+    deleted_at is not null;
@@ -0,0 +1,4 @@
+create table media_stars (
+    media_id integer primary key references medias (id) on delete cascade,
+    created timestamptz not null default now()
+);
@@ -0,0 +1,12 @@
+create type visibility as enum (
+    'public',
+    'private'
+);
+
+alter table medias
+    add column visibility visibility;
+
+create table directory_visibilities (
+    directory_alias text primary key,
+    visibility visibility not null
+);
@@ -0,0 +1,15 @@
+create table shares (
+    id serial primary key,
+    token text not null,
+    media_id integer not null references medias (id) on delete cascade,
+    created timestamptz not null default now(),
+    expires timestamptz,
+    max_views int,
+    views int not null default 0,
+    last_viewed timestamptz,
+    password_hash text
+);
+
+create unique index idx_shares_token on shares (token);
+
+create index idx_shares_media_id on shares (media_id);
@@ -0,0 +1,29 @@
+create type user_role as enum (
+    'admin',
+    'member'
+);
+
+create table users (
+    id serial primary key,
+    username text not null,
+    password_hash text not null,
+    role user_role not null,
+    created timestamptz not null default now()
+);
+
+create unique index idx_users_username on users (username);
+
+alter table medias
+    add column owner_id integer references users (id) on delete set null;
+
+create index idx_medias_owner_id on medias (owner_id);
+
+-- stars belong to users now. stars from before there were users are given to the first
+-- admin when they are created
+alter table media_stars
+    drop constraint media_stars_pkey;
+
+alter table media_stars
+    add column user_id integer references users (id) on delete cascade;
+
+create unique index idx_media_stars_user_id_media_id on media_stars (user_id, media_id);
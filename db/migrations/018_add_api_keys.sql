@@ -0,0 +1,21 @@
+create type api_key_scope as enum (
+    'upload',
+    'read',
+    'admin'
+);
+
+-- keys are random, so they are stored as a plain sha256 which can be looked up. keys
+-- without a user are from the SOCR_API_KEY env var
+create table api_keys (
+    id serial primary key,
+    name text not null,
+    key_hash text not null,
+    scope api_key_scope not null,
+    user_id integer references users (id) on delete cascade,
+    created timestamptz not null default now(),
+    last_used timestamptz
+);
+
+create unique index idx_api_keys_key_hash on api_keys (key_hash);
+
+create index idx_api_keys_user_id on api_keys (user_id);
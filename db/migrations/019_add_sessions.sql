@@ -0,0 +1,25 @@
+-- sessions are how access tokens are refreshed. refresh tokens are random, so they are
+-- stored as a plain sha256 like api keys
+create table sessions (
+    id serial primary key,
+    user_id integer not null references users (id) on delete cascade,
+    token_hash text not null,
+    created timestamptz not null default now(),
+    expires timestamptz not null,
+    last_used timestamptz
+);
+
+create unique index idx_sessions_token_hash on sessions (token_hash);
+
+create index idx_sessions_user_id on sessions (user_id);
+
+-- access tokens which were revoked before they expired, by their jti claim. they are
+-- deleted once they would have expired anyway
+create table revoked_tokens (
+    jti text primary key,
+    expires timestamptz not null
+);
+
+-- access tokens issued before this are revoked, for logging out of every session
+alter table users
+    add column tokens_revoked_at timestamptz;
@@ -0,0 +1,11 @@
+-- the subjects of openid connect issuers which users log in as. users are linked by
+-- subject rather than by username, since an issuer's usernames can change
+create table user_identities (
+    issuer text not null,
+    subject text not null,
+    user_id integer not null references users (id) on delete cascade,
+    created timestamptz not null default now(),
+    primary key (issuer, subject)
+);
+
+create index idx_user_identities_user_id on user_identities (user_id);
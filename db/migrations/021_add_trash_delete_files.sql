@@ -0,0 +1,10 @@
+-- whether a media's files are deleted along with it when it's deleted from the trash
+alter table medias
+    add column delete_files boolean not null default false;
+
+-- the hashes of media which were deleted from the trash while their files were kept.
+-- they aren't imported again when their directories are scanned
+create table purged_hashes (
+    hash text primary key,
+    purged timestamptz not null default now()
+);
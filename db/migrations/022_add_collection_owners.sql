@@ -0,0 +1,6 @@
+-- collections belong to the user who created them. collections from before there were
+-- users, or made with the api key from the env, belong to no one and only admins see them
+alter table collections
+    add column owner_id integer references users (id) on delete cascade;
+
+create index idx_collections_owner_id on collections (owner_id);
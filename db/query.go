@@ -0,0 +1,326 @@
+package db
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Query is a node of a parsed search query. see ParseQuery
+type Query interface {
+	isQuery()
+}
+
+// QueryText matches media with a block fuzzily matching Text, or containing it
+// exactly if Phrase is set
+type QueryText struct {
+	Text   string
+	Phrase bool
+}
+
+// QueryField matches media by a property other than its text, eg. "dir:phone"
+type QueryField struct {
+	Field string
+	Value string
+}
+
+type QueryNot struct{ Query Query }
+type QueryAnd []Query
+type QueryOr []Query
+
+func (QueryText) isQuery()  {}
+func (QueryField) isQuery() {}
+func (QueryNot) isQuery()   {}
+func (QueryAnd) isQuery()   {}
+func (QueryOr) isQuery()    {}
+
+const (
+	QueryFieldDirectory = "dir"
+	QueryFieldType      = "type"
+	QueryFieldTag       = "tag"
+)
+
+func isQueryField(f string) bool {
+	switch f {
+	case QueryFieldDirectory, QueryFieldType, QueryFieldTag:
+		return true
+	}
+	return false
+}
+
+// ParseQuery parses a search query such as
+//
+//	error timeout -staging ("disk full" OR oom) dir:phone
+//
+// runs of bare words are kept together as a single fuzzy text match, as they were
+// before the query language existed. quoted phrases match exactly, a leading "-"
+// negates, AND binds tighter than OR and is implied between terms, and parentheses
+// group. the parser is lenient since it runs as the user types, so stray operators
+// and unbalanced quotes or parentheses are tolerated rather than reported. it returns
+// nil if the query has no terms
+func ParseQuery(query string) Query {
+	p := &queryParser{tokens: tokeniseQuery(query)}
+	var terms QueryOr
+	for p.more() {
+		if p.peek().kind == tokRParen {
+			p.next() // stray closing paren, skip it
+			continue
+		}
+		if or := p.parseOr(); or != nil {
+			terms = append(terms, or)
+		}
+	}
+	return simplifyQuery(QueryAnd(terms))
+}
+
+type queryTokenKind int
+
+const (
+	tokWord queryTokenKind = iota
+	tokPhrase
+	tokField
+	tokNot
+	tokAnd
+	tokOr
+	tokLParen
+	tokRParen
+)
+
+type queryToken struct {
+	kind  queryTokenKind
+	field string
+	value string
+}
+
+func tokeniseQuery(query string) []queryToken {
+	var tokens []queryToken
+	rs := []rune(query)
+	for i := 0; i < len(rs); {
+		switch r := rs[i]; {
+		case unicode.IsSpace(r):
+			i++
+		case r == '(':
+			tokens = append(tokens, queryToken{kind: tokLParen})
+			i++
+		case r == ')':
+			tokens = append(tokens, queryToken{kind: tokRParen})
+			i++
+		case r == '-' && i+1 < len(rs) && !unicode.IsSpace(rs[i+1]):
+			tokens = append(tokens, queryToken{kind: tokNot})
+			i++
+		case r == '"':
+			var value string
+			value, i = readQuoted(rs, i)
+			if strings.TrimSpace(value) != "" {
+				tokens = append(tokens, queryToken{kind: tokPhrase, value: value})
+			}
+		default:
+			start := i
+			for i < len(rs) && !unicode.IsSpace(rs[i]) && rs[i] != '(' && rs[i] != ')' && rs[i] != '"' {
+				i++
+			}
+			word := string(rs[start:i])
+			if field, value, ok := strings.Cut(word, ":"); ok && isQueryField(strings.ToLower(field)) {
+				if value == "" && i < len(rs) && rs[i] == '"' {
+					value, i = readQuoted(rs, i)
+				}
+				tokens = append(tokens, queryToken{kind: tokField, field: strings.ToLower(field), value: value})
+				continue
+			}
+			switch word {
+			case "AND":
+				tokens = append(tokens, queryToken{kind: tokAnd})
+			case "OR":
+				tokens = append(tokens, queryToken{kind: tokOr})
+			default:
+				tokens = append(tokens, queryToken{kind: tokWord, value: word})
+			}
+		}
+	}
+	return tokens
+}
+
+// readQuoted reads from the opening quote at rs[i] until the closing quote or
+// end of input, returning the contents and the index after the closing quote
+func readQuoted(rs []rune, i int) (string, int) {
+	start := i + 1
+	end := start
+	for end < len(rs) && rs[end] != '"' {
+		end++
+	}
+	next := end
+	if next < len(rs) {
+		next++
+	}
+	return string(rs[start:end]), next
+}
+
+type queryParser struct {
+	tokens []queryToken
+	pos    int
+}
+
+func (p *queryParser) more() bool       { return p.pos < len(p.tokens) }
+func (p *queryParser) peek() queryToken { return p.tokens[p.pos] }
+func (p *queryParser) next() queryToken { p.pos++; return p.tokens[p.pos-1] }
+func (p *queryParser) nextIs(k queryTokenKind) bool {
+	return p.more() && p.peek().kind == k
+}
+
+func (p *queryParser) parseOr() Query {
+	var terms QueryOr
+	for {
+		if and := p.parseAnd(); and != nil {
+			terms = append(terms, and)
+		}
+		if !p.nextIs(tokOr) {
+			break
+		}
+		p.next()
+	}
+	return simplifyQuery(terms)
+}
+
+func (p *queryParser) parseAnd() Query {
+	var terms QueryAnd
+	for p.more() {
+		switch p.peek().kind {
+		case tokOr, tokRParen:
+			return simplifyQuery(terms)
+		case tokAnd:
+			p.next()
+			continue
+		}
+		if unary := p.parseUnary(); unary != nil {
+			terms = append(terms, unary)
+		}
+	}
+	return simplifyQuery(terms)
+}
+
+func (p *queryParser) parseUnary() Query {
+	if p.nextIs(tokNot) {
+		p.next()
+		if !p.more() {
+			return nil
+		}
+		inner := p.parseUnary()
+		if inner == nil {
+			return nil
+		}
+		if not, ok := inner.(QueryNot); ok {
+			return not.Query
+		}
+		return QueryNot{Query: inner}
+	}
+	return p.parseAtom()
+}
+
+func (p *queryParser) parseAtom() Query {
+	tok := p.next()
+	switch tok.kind {
+	case tokLParen:
+		inner := p.parseOr()
+		if p.nextIs(tokRParen) {
+			p.next()
+		}
+		return inner
+	case tokPhrase:
+		return QueryText{Text: tok.value, Phrase: true}
+	case tokField:
+		if tok.value == "" {
+			return nil
+		}
+		return QueryField{Field: tok.field, Value: tok.value}
+	case tokWord:
+		words := []string{tok.value}
+		for p.nextIs(tokWord) {
+			words = append(words, p.next().value)
+		}
+		return QueryText{Text: strings.Join(words, " ")}
+	case tokNot, tokAnd, tokOr, tokRParen:
+	}
+	return nil
+}
+
+// simplifyQuery unwraps empty and single item groups
+func simplifyQuery(q Query) Query {
+	switch q := q.(type) {
+	case QueryAnd:
+		switch len(q) {
+		case 0:
+			return nil
+		case 1:
+			return q[0]
+		}
+	case QueryOr:
+		switch len(q) {
+		case 0:
+			return nil
+		case 1:
+			return q[0]
+		}
+	}
+	return q
+}
+
+// highlighter finds the spans of a block's body matched by the text terms of a query.
+// fuzzy terms have no exact span, so blocks matching only those have none. neither do
+// regular expressions which postgres accepts but go can't compile, such as lookaheads
+type highlighter []*regexp.Regexp
+
+func newHighlighter(texts []QueryText, mode MatchMode) highlighter {
+	var h highlighter
+	for _, text := range texts {
+		var expr string
+		switch {
+		case mode == MatchModeRegex:
+			expr = "(?i)" + text.Text
+		case mode == MatchModeExact:
+			expr = regexp.QuoteMeta(text.Text)
+		case mode == MatchModeInsensitive, text.Phrase:
+			expr = "(?i)" + regexp.QuoteMeta(text.Text)
+		default:
+			continue
+		}
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			continue
+		}
+		h = append(h, re)
+	}
+	return h
+}
+
+func (h highlighter) spans(body string) []Span {
+	var byteSpans [][]int
+	for _, re := range h {
+		for _, loc := range re.FindAllStringIndex(body, -1) {
+			if loc[0] != loc[1] {
+				byteSpans = append(byteSpans, loc)
+			}
+		}
+	}
+	if len(byteSpans) == 0 {
+		return nil
+	}
+	sort.Slice(byteSpans, func(i, j int) bool {
+		return byteSpans[i][0] < byteSpans[j][0]
+	})
+
+	var spans []Span
+	for _, loc := range byteSpans {
+		span := Span{
+			Start: utf8.RuneCountInString(body[:loc[0]]),
+			End:   utf8.RuneCountInString(body[:loc[1]]),
+		}
+		if last := len(spans) - 1; last >= 0 && span.Start <= spans[last].End {
+			spans[last].End = max(spans[last].End, span.End)
+			continue
+		}
+		spans = append(spans, span)
+	}
+	return spans
+}
@@ -0,0 +1,50 @@
+package db_test
+
+import (
+	"reflect"
+	"testing"
+
+	"go.senan.xyz/socr/db"
+)
+
+func TestParseQuery(t *testing.T) {
+	tcases := []struct {
+		query    string
+		expected db.Query
+	}{
+		{query: "", expected: nil},
+		{query: "   ", expected: nil},
+		{query: "error timeout", expected: db.QueryText{Text: "error timeout"}},
+		{query: `"disk full"`, expected: db.QueryText{Text: "disk full", Phrase: true}},
+		{query: `"unterminated phrase`, expected: db.QueryText{Text: "unterminated phrase", Phrase: true}},
+		{query: "error AND timeout", expected: db.QueryAnd{db.QueryText{Text: "error"}, db.QueryText{Text: "timeout"}}},
+		{query: "error OR timeout", expected: db.QueryOr{db.QueryText{Text: "error"}, db.QueryText{Text: "timeout"}}},
+		{query: "error or timeout", expected: db.QueryText{Text: "error or timeout"}},
+		{query: "x-ray -staging", expected: db.QueryAnd{db.QueryText{Text: "x-ray"}, db.QueryNot{Query: db.QueryText{Text: "staging"}}}},
+		{query: "--staging", expected: db.QueryText{Text: "staging"}},
+		{query: "dir:phone type:video", expected: db.QueryAnd{db.QueryField{Field: "dir", Value: "phone"}, db.QueryField{Field: "type", Value: "video"}}},
+		{query: `DIR:"my phone"`, expected: db.QueryField{Field: "dir", Value: "my phone"}},
+		{query: "tag:bug -tag:done", expected: db.QueryAnd{db.QueryField{Field: "tag", Value: "bug"}, db.QueryNot{Query: db.QueryField{Field: "tag", Value: "done"}}}},
+		{query: "dir:", expected: nil},
+		{query: "http://example.com", expected: db.QueryText{Text: "http://example.com"}},
+		{query: "a OR b c", expected: db.QueryOr{db.QueryText{Text: "a"}, db.QueryText{Text: "b c"}}},
+		{query: "a b OR c AND -d", expected: db.QueryOr{
+			db.QueryText{Text: "a b"},
+			db.QueryAnd{db.QueryText{Text: "c"}, db.QueryNot{Query: db.QueryText{Text: "d"}}},
+		}},
+		{query: `error -(dir:phone OR "staging")`, expected: db.QueryAnd{
+			db.QueryText{Text: "error"},
+			db.QueryNot{Query: db.QueryOr{db.QueryField{Field: "dir", Value: "phone"}, db.QueryText{Text: "staging", Phrase: true}}},
+		}},
+		{query: "(a OR b", expected: db.QueryOr{db.QueryText{Text: "a"}, db.QueryText{Text: "b"}}},
+		{query: "a) b", expected: db.QueryAnd{db.QueryText{Text: "a"}, db.QueryText{Text: "b"}}},
+		{query: "OR AND a OR", expected: db.QueryText{Text: "a"}},
+	}
+
+	for _, tcase := range tcases {
+		result := db.ParseQuery(tcase.query)
+		if !reflect.DeepEqual(result, tcase.expected) {
+			t.Errorf("query %q parsed %#v expected %#v", tcase.query, result, tcase.expected)
+		}
+	}
+}
@@ -14,6 +14,25 @@ type Block struct {
 	MaxX    int     `db:"max_x"    json:"max_x"`
 	MaxY    int     `db:"max_y"    json:"max_y"`
 	Body    string  `db:"body"     json:"body"`
+	Manual  bool    `db:"manual"   json:"manual"`
+	Spans   []Span  `db:"-"        json:"spans,omitempty"`
+}
+
+// BlockRemoval is the box of a block which was deleted by hand, so that text found
+// there again when reprocessing is left out
+type BlockRemoval struct {
+	ID      int     `db:"id"`
+	MediaID MediaID `db:"media_id"`
+	MinX    int     `db:"min_x"`
+	MinY    int     `db:"min_y"`
+	MaxX    int     `db:"max_x"`
+	MaxY    int     `db:"max_y"`
+}
+
+// Span is a matched range of a block's body, in characters. End is exclusive
+type Span struct {
+	Start int `json:"start"`
+	End   int `json:"end"`
 }
 
 type MediaType string
@@ -23,22 +42,116 @@ const (
 	MediaTypeVideo MediaType = "video"
 )
 
+type MatchMode string
+
+const (
+	MatchModeFuzzy       MatchMode = "fuzzy"
+	MatchModeExact       MatchMode = "exact"
+	MatchModeInsensitive MatchMode = "insensitive"
+	MatchModeRegex       MatchMode = "regex"
+	MatchModeFullText    MatchMode = "fulltext"
+)
+
+type Orientation string
+
+const (
+	OrientationPortrait  Orientation = "portrait"
+	OrientationLandscape Orientation = "landscape"
+	OrientationSquare    Orientation = "square"
+)
+
+type UserRole string
+
+const (
+	UserRoleAdmin  UserRole = "admin"
+	UserRoleMember UserRole = "member"
+)
+
+type UserID int
+type User struct {
+	ID              UserID     `db:"id"                json:"id"`
+	Username        string     `db:"username"          json:"username"`
+	PasswordHash    string     `db:"password_hash"     json:"-"`
+	Role            UserRole   `db:"role"              json:"role"`
+	Created         time.Time  `db:"created"           json:"created"`
+	TokensRevokedAt *time.Time `db:"tokens_revoked_at" json:"-"`
+}
+
+func (u *User) IsAdmin() bool { return u.Role == UserRoleAdmin }
+
+type SessionID int
+type Session struct {
+	ID        SessionID  `db:"id"         json:"id"`
+	UserID    UserID     `db:"user_id"    json:"user_id"`
+	TokenHash string     `db:"token_hash" json:"-"`
+	Created   time.Time  `db:"created"    json:"created"`
+	Expires   time.Time  `db:"expires"    json:"expires"`
+	LastUsed  *time.Time `db:"last_used"  json:"last_used,omitempty"`
+}
+
+// APIKeyScope is what an api key may do. admin keys may do anything their user can,
+// except for managing sessions and api keys, which needs a user's token
+type APIKeyScope string
+
+const (
+	APIKeyScopeUpload APIKeyScope = "upload"
+	APIKeyScopeRead   APIKeyScope = "read"
+	APIKeyScopeAdmin  APIKeyScope = "admin"
+)
+
+type APIKeyID int
+type APIKey struct {
+	ID       APIKeyID    `db:"id"        json:"id"`
+	Name     string      `db:"name"      json:"name"`
+	KeyHash  string      `db:"key_hash"  json:"-"`
+	Scope    APIKeyScope `db:"scope"     json:"scope"`
+	UserID   *UserID     `db:"user_id"   json:"user_id,omitempty"`
+	Created  time.Time   `db:"created"   json:"created"`
+	LastUsed *time.Time  `db:"last_used" json:"last_used,omitempty"`
+}
+
+func (k *APIKey) Allows(scope APIKeyScope) bool {
+	return k.Scope == APIKeyScopeAdmin || k.Scope == scope
+}
+
+// Visibility is whether media can be seen without logging in. media without a
+// visibility of their own take it from their directories
+type Visibility string
+
+const (
+	VisibilityPublic  Visibility = "public"
+	VisibilityPrivate Visibility = "private"
+)
+
 type MediaID int
 type Media struct {
-	ID                MediaID   `db:"id"                 json:"id"`
-	Type              MediaType `db:"type"               json:"type"`
-	MIME              string    `db:"mime"               json:"mime"`
-	Hash              string    `db:"hash"               json:"hash"`
-	Timestamp         time.Time `db:"timestamp"          json:"timestamp"`
-	DimWidth          int       `db:"dim_width"          json:"dim_width"`
-	DimHeight         int       `db:"dim_height"         json:"dim_height"`
-	DominantColour    string    `db:"dominant_colour"    json:"dominant_colour"`
-	Blurhash          string    `db:"blurhash"           json:"blurhash"`
-	Similarity        float64   `db:"similarity"         json:"similarity,omitempty"`
-	Blocks            []*Block  `db:"blocks"             json:"blocks,omitempty"`
-	HighlightedBlocks []*Block  `db:"highlighted_blocks" json:"highlighted_blocks,omitempty"`
-	Directories       []string  `db:"directories"        json:"directories,omitempty"`
-	Processed         bool      `db:"processed"          json:"processed"`
+	ID                MediaID     `db:"id"                 json:"id"`
+	Type              MediaType   `db:"type"               json:"type"`
+	MIME              string      `db:"mime"               json:"mime"`
+	Hash              string      `db:"hash"               json:"hash"`
+	Timestamp         time.Time   `db:"timestamp"          json:"timestamp"`
+	DimWidth          int         `db:"dim_width"          json:"dim_width"`
+	DimHeight         int         `db:"dim_height"         json:"dim_height"`
+	DominantColour    string      `db:"dominant_colour"    json:"dominant_colour"`
+	Blurhash          string      `db:"blurhash"           json:"blurhash"`
+	Similarity        float64     `db:"similarity"         json:"similarity,omitempty"`
+	Rank              float64     `db:"rank"               json:"rank,omitempty"`
+	Headline          string      `db:"headline"           json:"headline,omitempty"`
+	ColourDistance    float64     `db:"colour_distance"    json:"colour_distance,omitempty"`
+	Palette           []*Colour   `db:"palette"            json:"palette,omitempty"`
+	Tags              []string    `db:"tags"               json:"tags,omitempty"`
+	Position          *int        `db:"position"           json:"position,omitempty"`
+	Blocks            []*Block    `db:"blocks"             json:"blocks,omitempty"`
+	HighlightedBlocks []*Block    `db:"highlighted_blocks" json:"highlighted_blocks,omitempty"`
+	Directories       []string    `db:"directories"        json:"directories,omitempty"`
+	Processed         bool        `db:"processed"          json:"processed"`
+	Starred           bool        `db:"starred"            json:"starred"`
+	Visibility        *Visibility `db:"visibility"         json:"visibility,omitempty"`
+	Public            bool        `db:"public"             json:"public"`
+	OwnerID           *UserID     `db:"owner_id"           json:"owner_id,omitempty"`
+	Note              string      `db:"note"               json:"note"`
+	DeletedAt         *time.Time  `db:"deleted_at"         json:"deleted_at,omitempty"`
+	NoteSpans         []Span      `db:"-"                  json:"note_spans,omitempty"`
 }
 
 type ThumbnailID int
@@ -52,6 +165,74 @@ type Thumbnail struct {
 	Data      []byte      `db:"data"       json:"-"`
 }
 
+// Colour is one of the dominant colours of a media. the CIELAB components are
+// used for searching by perceptual distance
+type Colour struct {
+	MediaID MediaID `db:"media_id" json:"media_id"`
+	Index   int     `db:"index"    json:"index"`
+	Hex     string  `db:"hex"      json:"hex"`
+	Weight  float64 `db:"weight"   json:"weight"`
+	LabL    float64 `db:"lab_l"    json:"lab_l"`
+	LabA    float64 `db:"lab_a"    json:"lab_a"`
+	LabB    float64 `db:"lab_b"    json:"lab_b"`
+}
+
+type Lab struct {
+	L, A, B float64
+}
+
+type TagID int
+type Tag struct {
+	ID   TagID  `db:"id"   json:"id"`
+	Name string `db:"name" json:"name"`
+}
+
+type TagCount struct {
+	Name  string `db:"name"  json:"name"`
+	Count int    `db:"count" json:"count"`
+}
+
+type TagsMatch string
+
+const (
+	TagsMatchAny TagsMatch = "any"
+	TagsMatchAll TagsMatch = "all"
+)
+
+type CollectionID int
+type Collection struct {
+	ID           CollectionID `db:"id"             json:"id"`
+	Name         string       `db:"name"           json:"name"`
+	CoverMediaID *MediaID     `db:"cover_media_id" json:"cover_media_id"`
+	OwnerID      *UserID      `db:"owner_id"       json:"owner_id,omitempty"`
+	Created      time.Time    `db:"created"        json:"created"`
+	// CoverHash is the hash of the cover, or of the first media if there is no cover
+	CoverHash *string `db:"cover_hash" json:"cover_hash,omitempty"`
+	Count     int     `db:"count"      json:"count"`
+}
+
+type ShareID int
+type Share struct {
+	ID           ShareID    `db:"id"            json:"id"`
+	Token        string     `db:"token"         json:"token"`
+	MediaID      MediaID    `db:"media_id"      json:"media_id"`
+	MediaHash    string     `db:"media_hash"    json:"media_hash"`
+	Created      time.Time  `db:"created"       json:"created"`
+	Expires      *time.Time `db:"expires"       json:"expires,omitempty"`
+	MaxViews     *int       `db:"max_views"     json:"max_views,omitempty"`
+	Views        int        `db:"views"         json:"views"`
+	LastViewed   *time.Time `db:"last_viewed"   json:"last_viewed,omitempty"`
+	PasswordHash *string    `db:"password_hash" json:"-"`
+	HasPassword  bool       `db:"has_password"  json:"has_password"`
+}
+
+// DeletedMedia is a media which has been deleted, and the files it was imported from
+type DeletedMedia struct {
+	Hash        string     `db:"hash"         json:"hash"`
+	Files       []*DirInfo `db:"files"        json:"files"`
+	DeleteFiles bool       `db:"delete_files" json:"-"`
+}
+
 type DirInfo struct {
 	MediaID        MediaID `db:"media_id"        json:"media_id"`
 	Filename       string  `db:"filename"        json:"filename"`
@@ -59,6 +240,19 @@ type DirInfo struct {
 }
 
 type DirectoryCount struct {
-	DirectoryAlias string `db:"directory_alias" json:"directory_alias"`
-	Count          int    `db:"count"           json:"count"`
+	DirectoryAlias string     `db:"directory_alias" json:"directory_alias"`
+	Count          int        `db:"count"           json:"count"`
+	Visibility     Visibility `db:"visibility"      json:"visibility"`
+}
+
+type SearchFacets struct {
+	Total       int           `db:"total"       json:"total"`
+	Directories []*FacetCount `db:"directories" json:"directories"`
+	Types       []*FacetCount `db:"types"       json:"types"`
+	Months      []*FacetCount `db:"months"      json:"months"`
+}
+
+type FacetCount struct {
+	Value string `json:"value"`
+	Count int    `json:"count"`
 }
@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"image"
 	"image/color"
+	"math"
 	"net/http"
 	"os"
 	"os/exec"
@@ -102,6 +103,71 @@ func DominantColour(img image.Image) (color.Color, string) {
 	return colour, hex
 }
 
+const PaletteSize = 5
+
+type PaletteColour struct {
+	Colour color.RGBA
+	Hex    string
+	Weight float64
+}
+
+// Palette finds the n most dominant colours of an image, in order of dominance
+func Palette(img image.Image, n int) []PaletteColour {
+	weighted := dominantcolor.FindWeight(img, n)
+	palette := make([]PaletteColour, 0, len(weighted))
+	for _, c := range weighted {
+		palette = append(palette, PaletteColour{
+			Colour: c.RGBA,
+			Hex:    dominantcolor.Hex(c.RGBA),
+			Weight: c.Weight,
+		})
+	}
+	return palette
+}
+
+// ParseHex parses a colour such as "#ff0000", "ff0000", or "#f00"
+func ParseHex(hex string) (color.RGBA, error) {
+	hex = strings.TrimPrefix(hex, "#")
+	if len(hex) == 3 {
+		hex = string([]byte{hex[0], hex[0], hex[1], hex[1], hex[2], hex[2]})
+	}
+	if len(hex) != 6 {
+		return color.RGBA{}, fmt.Errorf("invalid hex colour %q", hex)
+	}
+	v, err := strconv.ParseUint(hex, 16, 32)
+	if err != nil {
+		return color.RGBA{}, fmt.Errorf("invalid hex colour %q: %w", hex, err)
+	}
+	return color.RGBA{R: uint8(v >> 16), G: uint8(v >> 8), B: uint8(v), A: 0xff}, nil
+}
+
+// Lab converts a colour to CIELAB (D65), where euclidean distance roughly matches
+// the perceived difference between colours
+func Lab(c color.Color) (l, a, b float64) {
+	linear := func(v uint32) float64 {
+		c := float64(v) / 0xffff
+		if c <= 0.04045 {
+			return c / 12.92
+		}
+		return math.Pow((c+0.055)/1.055, 2.4)
+	}
+	cr, cg, cb, _ := c.RGBA()
+	lr, lg, lb := linear(cr), linear(cg), linear(cb)
+
+	x := (0.4124*lr + 0.3576*lg + 0.1805*lb) / 0.95047
+	y := (0.2126*lr + 0.7152*lg + 0.0722*lb) / 1.00000
+	z := (0.0193*lr + 0.1192*lg + 0.9505*lb) / 1.08883
+
+	f := func(t float64) float64 {
+		if t > 216.0/24389.0 {
+			return math.Cbrt(t)
+		}
+		return (24389.0/27.0*t + 16) / 116
+	}
+	fx, fy, fz := f(x), f(y), f(z)
+	return 116*fy - 16, 500 * (fx - fy), 200 * (fy - fz)
+}
+
 func VideoThumbnail(data []byte) (image.Image, error) {
 	tmp, err := os.CreateTemp("", "")
 	if err != nil {
@@ -0,0 +1,54 @@
+package imagery_test
+
+import (
+	"image/color"
+	"math"
+	"testing"
+
+	"go.senan.xyz/socr/imagery"
+)
+
+func TestParseHex(t *testing.T) {
+	tcases := []struct {
+		hex    string
+		colour color.RGBA
+		err    bool
+	}{
+		{hex: "#ff8000", colour: color.RGBA{R: 0xff, G: 0x80, B: 0x00, A: 0xff}},
+		{hex: "FF8000", colour: color.RGBA{R: 0xff, G: 0x80, B: 0x00, A: 0xff}},
+		{hex: "#f80", colour: color.RGBA{R: 0xff, G: 0x88, B: 0x00, A: 0xff}},
+		{hex: "#ff80", err: true},
+		{hex: "#gg8000", err: true},
+	}
+
+	for _, tcase := range tcases {
+		colour, err := imagery.ParseHex(tcase.hex)
+		if (err != nil) != tcase.err {
+			t.Errorf("hex %q returned error %v", tcase.hex, err)
+			continue
+		}
+		if colour != tcase.colour {
+			t.Errorf("hex %q parsed %v expected %v", tcase.hex, colour, tcase.colour)
+		}
+	}
+}
+
+func TestLab(t *testing.T) {
+	tcases := []struct {
+		colour  color.Color
+		l, a, b float64
+	}{
+		{colour: color.White, l: 100, a: 0, b: 0},
+		{colour: color.Black, l: 0, a: 0, b: 0},
+		{colour: color.RGBA{R: 0xff, A: 0xff}, l: 53.24, a: 80.09, b: 67.20},
+		{colour: color.RGBA{B: 0xff, A: 0xff}, l: 32.30, a: 79.19, b: -107.86},
+	}
+
+	const tolerance = 0.05
+	for _, tcase := range tcases {
+		l, a, b := imagery.Lab(tcase.colour)
+		if math.Abs(l-tcase.l) > tolerance || math.Abs(a-tcase.a) > tolerance || math.Abs(b-tcase.b) > tolerance {
+			t.Errorf("colour %v converted to %.2f %.2f %.2f expected %.2f %.2f %.2f", tcase.colour, l, a, b, tcase.l, tcase.a, tcase.b)
+		}
+	}
+}
@@ -0,0 +1,130 @@
+package importer
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+type EventType string
+
+const (
+	EventMediaCreated   EventType = "media_created"
+	EventMediaProcessed EventType = "media_processed"
+	EventMediaRestored  EventType = "media_restored"
+	EventScanError      EventType = "scan_error"
+)
+
+// Event is something which happened to a media, or an error while scanning a file
+type Event struct {
+	Type     EventType
+	Time     time.Time
+	Hash     string
+	FileName string
+	Error    error
+}
+
+// Bus delivers the importer's events to subscribers without ever blocking the
+// importer. events are queued, and dropped for subscribers which have fallen too far
+// behind. progress events are coalesced, since subscribers only need to know that the
+// status has changed since they last looked. drops are logged once when a subscriber
+// falls behind, and counted up for when it catches up, so that a slow subscriber
+// during a big scan doesn't flood the log
+type Bus struct {
+	mu   sync.Mutex
+	subs map[*Subscription]struct{}
+}
+
+type Subscription struct {
+	bus      *Bus
+	events   chan Event
+	progress chan struct{}
+	dropping int // since the subscriber fell behind
+	dropped  int
+}
+
+func NewBus() *Bus {
+	return &Bus{
+		subs: map[*Subscription]struct{}{},
+	}
+}
+
+// Subscribe starts receiving events, queueing up to queue of them
+func (b *Bus) Subscribe(queue int) *Subscription {
+	sub := &Subscription{
+		bus:      b,
+		events:   make(chan Event, queue),
+		progress: make(chan struct{}, 1),
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.subs[sub] = struct{}{}
+	return sub
+}
+
+func (b *Bus) Publish(event Event) {
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for sub := range b.subs {
+		select {
+		case sub.events <- event:
+			if sub.dropping > 0 {
+				log.Printf("slow subscriber caught up after %d events were dropped", sub.dropping)
+				sub.dropping = 0
+			}
+		default:
+			if sub.dropping == 0 {
+				log.Printf("dropping events for slow subscriber, starting with %s", event.Type)
+			}
+			sub.dropping++
+			sub.dropped++
+		}
+	}
+}
+
+// PublishProgress tells subscribers that the import status has changed
+func (b *Bus) PublishProgress() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for sub := range b.subs {
+		select {
+		case sub.progress <- struct{}{}:
+		default:
+			// already pending
+		}
+	}
+}
+
+func (s *Subscription) Events() <-chan Event { return s.events }
+
+// Dropped counts the events which were dropped since the subscriber was too far behind
+func (s *Subscription) Dropped() int {
+	s.bus.mu.Lock()
+	defer s.bus.mu.Unlock()
+
+	return s.dropped
+}
+
+// Progress receives when the import status has changed
+func (s *Subscription) Progress() <-chan struct{} { return s.progress }
+
+// Close stops receiving events, and closes the subscription's channels
+func (s *Subscription) Close() {
+	s.bus.mu.Lock()
+	defer s.bus.mu.Unlock()
+
+	if _, ok := s.bus.subs[s]; !ok {
+		return
+	}
+	delete(s.bus.subs, s)
+	close(s.events)
+	close(s.progress)
+}
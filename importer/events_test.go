@@ -0,0 +1,48 @@
+package importer_test
+
+import (
+	"testing"
+
+	"go.senan.xyz/socr/importer"
+)
+
+func TestBus(t *testing.T) {
+	bus := importer.NewBus()
+	sub := bus.Subscribe(2)
+
+	// nothing is reading, but publishing must never block
+	for _, hash := range []string{"a", "b", "c", "d"} {
+		bus.Publish(importer.Event{Type: importer.EventMediaCreated, Hash: hash})
+	}
+	if dropped := sub.Dropped(); dropped != 2 {
+		t.Errorf("dropped %d events expected %d", dropped, 2)
+	}
+	for i := 0; i < 10; i++ {
+		bus.PublishProgress()
+	}
+
+	for _, expected := range []string{"a", "b"} {
+		if event := <-sub.Events(); event.Hash != expected {
+			t.Errorf("event hash %q expected %q", event.Hash, expected)
+		}
+	}
+	select {
+	case event := <-sub.Events():
+		t.Errorf("unexpected event %q past queue", event.Hash)
+	default:
+	}
+
+	<-sub.Progress()
+	select {
+	case <-sub.Progress():
+		t.Errorf("progress events weren't coalesced")
+	default:
+	}
+
+	sub.Close()
+	sub.Close()
+	bus.Publish(importer.Event{Type: importer.EventMediaCreated, Hash: "e"})
+	if _, ok := <-sub.Events(); ok {
+		t.Errorf("closed subscription received event")
+	}
+}
@@ -25,9 +25,6 @@ import (
 
 type EncodeFunc func(io.Writer, image.Image) error
 
-type NotifyMediaFunc func(hash string)
-type NotifyProgressFunc func()
-
 type Importer struct {
 	db                      *db.DB
 	defaultEncoder          EncodeFunc
@@ -36,10 +33,9 @@ type Importer struct {
 	directoriesUploadsAlias string
 	thumbnailWidth          uint
 
-	status              Status
-	jobs                chan *mediaFile
-	notifyMediaFuncs    []NotifyMediaFunc
-	notifyProgressFuncs []NotifyProgressFunc
+	status Status
+	jobs   chan *mediaFile
+	events *Bus
 }
 
 func New(
@@ -56,45 +52,57 @@ func New(
 
 		status: Status{mu: &sync.RWMutex{}},
 		jobs:   make(chan *mediaFile),
+		events: NewBus(),
 	}
 }
 
-func (i *Importer) AddNotifyMediaFunc(f NotifyMediaFunc) {
-	i.notifyMediaFuncs = append(i.notifyMediaFuncs, f)
-}
-
-func (i *Importer) AddNotifyProgressFunc(f NotifyProgressFunc) {
-	i.notifyProgressFuncs = append(i.notifyProgressFuncs, f)
+// Subscribe starts receiving the importer's events. see Bus
+func (i *Importer) Subscribe(queue int) *Subscription {
+	return i.events.Subscribe(queue)
 }
 
-func (i *Importer) ImportMedia(media imagery.Media, dirAlias string, fileName string, timestamp time.Time) error {
-	id, isOld, err := i.insertMedia(media, timestamp)
+// ImportMedia imports a media from a file in a directory. owner is the user who
+// uploaded it, or nil if it was found by scanning
+func (i *Importer) ImportMedia(media imagery.Media, dirAlias string, fileName string, timestamp time.Time, owner *db.UserID) error {
+	id, isOld, err := i.insertMedia(media, timestamp, owner)
 	if err != nil {
 		return fmt.Errorf("import media with props: %w", err)
 	}
 	if err := i.insertDirInfo(id, dirAlias, fileName); err != nil {
 		return fmt.Errorf("import dir info: %w", err)
 	}
-	for _, f := range i.notifyMediaFuncs {
-		f(media.Hash())
-	}
 
+	// old media were processed when they were first imported. if they were in the trash,
+	// importing them again takes them out of it
 	if isOld {
+		restored, err := i.db.RestoreMedias([]string{media.Hash()})
+		if err != nil {
+			return fmt.Errorf("restore media: %w", err)
+		}
+		if len(restored) > 0 {
+			i.events.Publish(Event{Type: EventMediaRestored, Hash: media.Hash(), FileName: fileName})
+		}
+		i.events.Publish(Event{Type: EventMediaProcessed, Hash: media.Hash(), FileName: fileName})
 		return nil
 	}
+	i.events.Publish(Event{Type: EventMediaCreated, Hash: media.Hash(), FileName: fileName})
 
 	if err := i.insertThumbnail(id, media.Image()); err != nil {
 		return fmt.Errorf("import thumbnail: %w", err)
 	}
+	if err := i.insertColours(id, media.Image()); err != nil {
+		return fmt.Errorf("import colours: %w", err)
+	}
 	if err := i.insertBlocks(id, media.Image()); err != nil {
 		return fmt.Errorf("import blocks: %w", err)
 	}
+	if err := i.db.UpdateTextSearch(id); err != nil {
+		return fmt.Errorf("update text search: %w", err)
+	}
 	if err := i.db.SetMediaProcessed(id); err != nil {
 		return fmt.Errorf("set media processed: %w", err)
 	}
-	for _, f := range i.notifyMediaFuncs {
-		f(media.Hash())
-	}
+	i.events.Publish(Event{Type: EventMediaProcessed, Hash: media.Hash(), FileName: fileName})
 
 	return nil
 }
@@ -121,9 +129,18 @@ func (i *Importer) ImportMediaFromFile(dirAlias, dir, fileName string, modTime t
 		return "", fmt.Errorf("decode and hash media: %w", err)
 	}
 
+	purged, err := i.db.IsHashPurged(media.Hash())
+	if err != nil {
+		return "", fmt.Errorf("checking purged: %w", err)
+	}
+	if purged {
+		log.Printf("skipping item deleted from trash. alias %q, filename %q", dirAlias, fileName)
+		return "", nil
+	}
+
 	timestamp := GuessFileCreated(fileName, modTime)
 
-	if err := i.ImportMedia(media, dirAlias, fileName, timestamp); err != nil {
+	if err := i.ImportMedia(media, dirAlias, fileName, timestamp, nil); err != nil {
 		return "", fmt.Errorf("importing media: %w", err)
 	}
 
@@ -198,19 +215,21 @@ func (i *Importer) StartWorker() {
 			s.LastHash = hash
 			s.AddError(err)
 		})
+		if err != nil {
+			i.events.Publish(Event{Type: EventScanError, FileName: j.fileName, Error: err})
+		}
 	}
 }
 
 func (i *Importer) updateStatus(f func(*Status)) {
 	i.status.mu.Lock()
-	defer i.status.mu.Unlock()
 	f(&i.status)
-	for _, f := range i.notifyProgressFuncs {
-		f()
-	}
+	i.status.mu.Unlock()
+
+	i.events.PublishProgress()
 }
 
-func (i *Importer) insertMedia(media imagery.Media, timestamp time.Time) (db.MediaID, bool, error) {
+func (i *Importer) insertMedia(media imagery.Media, timestamp time.Time, owner *db.UserID) (db.MediaID, bool, error) {
 	old, err := i.db.GetMediaByHash(media.Hash())
 	if err != nil && !errors.Is(err, pgx.ErrNoRows) {
 		return 0, false, fmt.Errorf("getting media by hash: %w", err)
@@ -236,6 +255,7 @@ func (i *Importer) insertMedia(media imagery.Media, timestamp time.Time) (db.Med
 		DimHeight:      propDimensions.Y,
 		DominantColour: propDominantColour,
 		Blurhash:       propBlurhash,
+		OwnerID:        owner,
 	})
 	if err != nil {
 		return 0, false, fmt.Errorf("inserting media: %w", err)
@@ -245,15 +265,26 @@ func (i *Importer) insertMedia(media imagery.Media, timestamp time.Time) (db.Med
 }
 
 func (i *Importer) insertBlocks(id db.MediaID, image image.Image) error {
+	blocks, err := i.extractBlocks(id, image)
+	if err != nil {
+		return err
+	}
+	if err := i.db.CreateBlocks(blocks); err != nil {
+		return fmt.Errorf("inserting blocks: %w", err)
+	}
+	return nil
+}
+
+func (i *Importer) extractBlocks(id db.MediaID, image image.Image) ([]*db.Block, error) {
 	imageGrey := imagery.GreyScale(image)
 	imageBig := imagery.ResizeFactor(imageGrey, imagery.ScaleFactor)
 	imageEncoded := &bytes.Buffer{}
 	if err := i.defaultEncoder(imageEncoded, imageBig); err != nil {
-		return fmt.Errorf("encode scaled and greyed image: %w", err)
+		return nil, fmt.Errorf("encode scaled and greyed image: %w", err)
 	}
 	rawBlocks, err := imagery.ExtractText(imageEncoded.Bytes())
 	if err != nil {
-		return fmt.Errorf("extract image text: %w", err)
+		return nil, fmt.Errorf("extract image text: %w", err)
 	}
 
 	blocks := make([]*db.Block, 0, len(rawBlocks))
@@ -273,13 +304,87 @@ func (i *Importer) insertBlocks(id db.MediaID, image image.Image) error {
 			Body:    rawBlock.Word,
 		})
 	}
+	return blocks, nil
+}
 
-	if err := i.db.CreateBlocks(blocks); err != nil {
-		return fmt.Errorf("inserting blocks: %w", err)
+// ReprocessMedia extracts the text of a media again, replacing its blocks. blocks
+// which were corrected by hand are kept, see ReprocessedBlocks
+func (i *Importer) ReprocessMedia(hash string) error {
+	dirInfo, err := i.db.GetDirInfoByMediaHash(hash)
+	if err != nil {
+		return fmt.Errorf("getting dir info: %w", err)
+	}
+	dir, ok := i.directories.PathByAlias(dirInfo.DirectoryAlias)
+	if !ok {
+		return fmt.Errorf("media has invalid alias %q", dirInfo.DirectoryAlias)
+	}
+	raw, err := os.ReadFile(filepath.Join(dir, dirInfo.Filename))
+	if err != nil {
+		return fmt.Errorf("open file: %w", err)
+	}
+	media, err := imagery.NewMedia(raw)
+	if err != nil {
+		return fmt.Errorf("decode and hash media: %w", err)
+	}
+
+	id := dirInfo.MediaID
+	blocks, err := i.extractBlocks(id, media.Image())
+	if err != nil {
+		return fmt.Errorf("extract blocks: %w", err)
+	}
+	manualBlocks, err := i.db.GetManualBlocks(id)
+	if err != nil {
+		return fmt.Errorf("getting manual blocks: %w", err)
+	}
+	removals, err := i.db.GetBlockRemovals(id)
+	if err != nil {
+		return fmt.Errorf("getting block removals: %w", err)
 	}
+
+	kept := ReprocessedBlocks(blocks, manualBlocks, removals)
+	if err := i.db.ReplaceBlocks(id, kept); err != nil {
+		return fmt.Errorf("replacing blocks: %w", err)
+	}
+	if err := i.db.UpdateTextSearch(id); err != nil {
+		return fmt.Errorf("update text search: %w", err)
+	}
+	i.events.Publish(Event{Type: EventMediaProcessed, Hash: hash})
 	return nil
 }
 
+// ReprocessedBlocks finds which of the blocks of a reprocessed media are kept alongside
+// its manual blocks. blocks which overlap a manual block or a block that was deleted by
+// hand are left out. the rest keep their OCR index, which is the reading order. blocks
+// corrected by hand keep the index they had too, so they take the place of the blocks
+// they overlap
+func ReprocessedBlocks(blocks []*db.Block, manualBlocks []*db.Block, removals []*db.BlockRemoval) []*db.Block {
+	corrected := make([]image.Rectangle, 0, len(manualBlocks)+len(removals))
+	for _, block := range manualBlocks {
+		corrected = append(corrected, image.Rect(block.MinX, block.MinY, block.MaxX, block.MaxY))
+	}
+	for _, removal := range removals {
+		corrected = append(corrected, image.Rect(removal.MinX, removal.MinY, removal.MaxX, removal.MaxY))
+	}
+
+	var kept []*db.Block
+	for _, block := range blocks {
+		if overlapsAny(image.Rect(block.MinX, block.MinY, block.MaxX, block.MaxY), corrected) {
+			continue
+		}
+		kept = append(kept, block)
+	}
+	return kept
+}
+
+func overlapsAny(rect image.Rectangle, rects []image.Rectangle) bool {
+	for _, r := range rects {
+		if rect.Overlaps(r) {
+			return true
+		}
+	}
+	return false
+}
+
 func (i *Importer) insertThumbnail(id db.MediaID, image image.Image) error {
 	resized := imagery.Resize(image, i.thumbnailWidth, 0)
 	dimensions := resized.Bounds().Size()
@@ -303,6 +408,54 @@ func (i *Importer) insertThumbnail(id db.MediaID, image image.Image) error {
 	return nil
 }
 
+func (i *Importer) insertColours(id db.MediaID, image image.Image) error {
+	palette := imagery.Palette(image, imagery.PaletteSize)
+	colours := make([]*db.Colour, 0, len(palette))
+	for idx, c := range palette {
+		l, a, b := imagery.Lab(c.Colour)
+		colours = append(colours, &db.Colour{
+			MediaID: id,
+			Index:   idx,
+			Hex:     c.Hex,
+			Weight:  c.Weight,
+			LabL:    l,
+			LabA:    a,
+			LabB:    b,
+		})
+	}
+	if err := i.db.CreateColours(colours); err != nil {
+		return fmt.Errorf("insert colours: %w", err)
+	}
+	return nil
+}
+
+// ImportMissingColours finds the colours of media imported before colours were
+// stored, using their thumbnails
+func (i *Importer) ImportMissingColours() error {
+	const batchSize = 100
+	var after db.MediaID
+	for {
+		thumbnails, err := i.db.GetThumbnailsWithoutColours(after, batchSize)
+		if err != nil {
+			return fmt.Errorf("get thumbnails: %w", err)
+		}
+		if len(thumbnails) == 0 {
+			return nil
+		}
+		for _, thumbnail := range thumbnails {
+			after = thumbnail.MediaID
+			img, _, err := image.Decode(bytes.NewReader(thumbnail.Data))
+			if err != nil {
+				log.Printf("error decoding thumbnail for media %d: %v", thumbnail.MediaID, err)
+				continue
+			}
+			if err := i.insertColours(thumbnail.MediaID, img); err != nil {
+				return fmt.Errorf("import colours for media %d: %w", thumbnail.MediaID, err)
+			}
+		}
+	}
+}
+
 func (i *Importer) insertDirInfo(id db.MediaID, dirAlias string, fileName string) error {
 	dirInfo := &db.DirInfo{
 		Filename:       fileName,
@@ -1,9 +1,12 @@
 package importer_test
 
 import (
+	"slices"
+	"sort"
 	"testing"
 	"time"
 
+	"go.senan.xyz/socr/db"
 	"go.senan.xyz/socr/importer"
 )
 
@@ -28,3 +31,50 @@ func TestGuessFileCreated(t *testing.T) {
 		}
 	}
 }
+
+func TestReprocessedBlocks(t *testing.T) {
+	block := func(index, minX, maxX int, body string) *db.Block {
+		return &db.Block{Index: index, MinX: minX, MinY: 0, MaxX: maxX, MaxY: 10, Body: body}
+	}
+
+	// a media whose first ocr block was corrected by hand, keeping its index, and which
+	// had a block added by hand after the four ocr blocks
+	manualBlocks := []*db.Block{
+		{Index: 0, MinX: 0, MinY: 0, MaxX: 10, MaxY: 10, Body: "corrected", Manual: true},
+		{Index: 4, MinX: 80, MinY: 0, MaxX: 90, MaxY: 10, Body: "added", Manual: true},
+	}
+	removals := []*db.BlockRemoval{
+		{MinX: 40, MinY: 0, MaxX: 50, MaxY: 10},
+	}
+	blocks := []*db.Block{
+		block(0, 0, 10, "wrong"),
+		block(1, 20, 30, "a"),
+		block(2, 40, 50, "removed"),
+		block(3, 60, 70, "b"),
+	}
+
+	kept := importer.ReprocessedBlocks(blocks, manualBlocks, removals)
+
+	// the media's blocks are read in index order, so the correction is still first
+	all := slices.Concat(kept, manualBlocks)
+	sort.SliceStable(all, func(i, j int) bool {
+		return all[i].Index < all[j].Index
+	})
+	expected := []struct {
+		index int
+		body  string
+	}{
+		{index: 0, body: "corrected"},
+		{index: 1, body: "a"},
+		{index: 3, body: "b"},
+		{index: 4, body: "added"},
+	}
+	if len(all) != len(expected) {
+		t.Fatalf("media has %d blocks expected %d", len(all), len(expected))
+	}
+	for i, tcase := range expected {
+		if all[i].Index != tcase.index || all[i].Body != tcase.body {
+			t.Errorf("block %d is %d %q expected %d %q", i, all[i].Index, all[i].Body, tcase.index, tcase.body)
+		}
+	}
+}
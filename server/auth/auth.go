@@ -1,34 +1,105 @@
 package auth
 
 import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"fmt"
 	"time"
 
 	"github.com/golang-jwt/jwt/v4"
+	"golang.org/x/crypto/bcrypt"
 )
 
-func TokenNew(secret string) (string, error) {
+const (
+	// TokenExpiry is how long access tokens last. they are short lived, and refreshed
+	// with a refresh token which lasts RefreshTokenExpiry
+	TokenExpiry        = 15 * time.Minute
+	RefreshTokenExpiry = 30 * 24 * time.Hour
+)
+
+// Claims are the claims of an access token. iat is only kept to the second, so the
+// time it was issued is kept to the microsecond too. that way tokens issued in the
+// same second as a user's tokens are revoked can be told apart from ones issued after
+type Claims struct {
+	jwt.RegisteredClaims
+	IssuedAtMicro int64 `json:"iat_us,omitempty"`
+}
+
+// Issued finds when the token was issued, to the second for tokens without iat_us
+func (c *Claims) Issued() time.Time {
+	if c.IssuedAtMicro == 0 {
+		return c.IssuedAt.Time
+	}
+	return time.UnixMicro(c.IssuedAtMicro)
+}
+
+// TokenNew makes an access token for a user, identified by subject, issued at now. it
+// has a random id so that it can be revoked
+func TokenNew(secret string, subject string, now time.Time) (string, error) {
+	id, err := RandomToken(16)
+	if err != nil {
+		return "", fmt.Errorf("generating id: %w", err)
+	}
 	return jwt.
-		NewWithClaims(jwt.SigningMethodHS256, jwt.RegisteredClaims{
-			ExpiresAt: jwt.NewNumericDate(time.Now().Add(7 * 24 * time.Hour)),
+		NewWithClaims(jwt.SigningMethodHS256, Claims{
+			RegisteredClaims: jwt.RegisteredClaims{
+				ID:        id,
+				Subject:   subject,
+				IssuedAt:  jwt.NewNumericDate(now),
+				ExpiresAt: jwt.NewNumericDate(now.Add(TokenExpiry)),
+			},
+			IssuedAtMicro: now.UnixMicro(),
 		}).
 		SignedString([]byte(secret))
 }
 
-func TokenParse(secret, tokenStr string) error {
-	token, err := jwt.Parse(tokenStr, func(token *jwt.Token) (any, error) {
+// TokenParse checks a token, and returns its claims
+func TokenParse(secret, tokenStr string) (*Claims, error) {
+	var claims Claims
+	token, err := jwt.ParseWithClaims(tokenStr, &claims, func(token *jwt.Token) (any, error) {
 		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
 			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
 		}
 		return []byte(secret), nil
 	})
 	if err != nil {
-		return fmt.Errorf("parsing token: %w", err)
+		return nil, fmt.Errorf("parsing token: %w", err)
+	}
+
+	if !token.Valid || claims.Subject == "" || claims.ID == "" || claims.IssuedAt == nil || claims.ExpiresAt == nil {
+		return nil, fmt.Errorf("unauthorised")
+	}
+
+	return &claims, nil
+}
+
+// RandomToken makes a url safe random token from n random bytes
+func RandomToken(n int) (string, error) {
+	raw := make([]byte, n)
+	if _, err := rand.Read(raw); err != nil {
+		return "", fmt.Errorf("reading random: %w", err)
 	}
+	return base64.RawURLEncoding.EncodeToString(raw), nil
+}
+
+// TokenHash hashes a random token, such as an api key or a refresh token, so that it
+// can be stored and looked up. they are random, so they don't need a slow hash like
+// passwords do
+func TokenHash(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
 
-	if _, ok := token.Claims.(jwt.MapClaims); !ok || !token.Valid {
-		return fmt.Errorf("unauthorised")
+func PasswordHash(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", fmt.Errorf("hashing password: %w", err)
 	}
+	return string(hash), nil
+}
 
-	return nil
+func PasswordCheck(hash, password string) bool {
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
 }
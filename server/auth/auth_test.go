@@ -0,0 +1,76 @@
+package auth_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+
+	"go.senan.xyz/socr/server/auth"
+)
+
+func TestToken(t *testing.T) {
+	token, err := auth.TokenNew("secret", "12", time.Now())
+	if err != nil {
+		t.Fatalf("making token: %v", err)
+	}
+	claims, err := auth.TokenParse("secret", token)
+	if err != nil {
+		t.Fatalf("parsing token: %v", err)
+	}
+	if claims.Subject != "12" {
+		t.Errorf("token subject %q expected %q", claims.Subject, "12")
+	}
+	if claims.ID == "" {
+		t.Errorf("token has no id")
+	}
+
+	other, _ := auth.TokenNew("secret", "12", time.Now())
+	if otherClaims, _ := auth.TokenParse("secret", other); otherClaims.ID == claims.ID {
+		t.Errorf("tokens have the same id %q", claims.ID)
+	}
+
+	tcases := []struct {
+		secret string
+		token  string
+	}{
+		{secret: "other secret", token: token},
+		{secret: "secret", token: token + "x"},
+		{secret: "secret", token: ""},
+	}
+	for _, tcase := range tcases {
+		if _, err := auth.TokenParse(tcase.secret, tcase.token); err == nil {
+			t.Errorf("expected error parsing token %q with secret %q", tcase.token, tcase.secret)
+		}
+	}
+}
+
+func TestTokenIssued(t *testing.T) {
+	second := time.Date(2021, 5, 18, 13, 14, 30, 0, time.UTC)
+	tcases := []struct {
+		issued   time.Time
+		expected time.Time
+	}{
+		{issued: second, expected: second},
+		{issued: second.Add(250 * time.Millisecond), expected: second.Add(250 * time.Millisecond)},
+		{issued: second.Add(250*time.Millisecond + 999*time.Nanosecond), expected: second.Add(250 * time.Millisecond)},
+	}
+	for _, tcase := range tcases {
+		token, err := auth.TokenNew("secret", "12", tcase.issued)
+		if err != nil {
+			t.Fatalf("making token: %v", err)
+		}
+		// tokens are parsed without checking their expiry here, since they were issued
+		// in the past
+		claims := &auth.Claims{}
+		if _, _, err := new(jwt.Parser).ParseUnverified(token, claims); err != nil {
+			t.Fatalf("parsing token: %v", err)
+		}
+		if !claims.Issued().Equal(tcase.expected) {
+			t.Errorf("token issued at %v has issued %v expected %v", tcase.issued, claims.Issued(), tcase.expected)
+		}
+		if !claims.IssuedAt.Time.Equal(second) {
+			t.Errorf("token issued at %v has iat %v expected %v", tcase.issued, claims.IssuedAt.Time, second)
+		}
+	}
+}
@@ -0,0 +1,189 @@
+package server
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"go.senan.xyz/socr/db"
+	"go.senan.xyz/socr/importer"
+	"go.senan.xyz/socr/server/socket"
+)
+
+// importerEventsQueue is how many events the server can fall behind the importer by
+// before they're dropped
+const importerEventsQueue = 256
+
+// sseHistory is how many events sse clients can catch up on when they reconnect
+const sseHistory = 256
+
+// socket and sse clients listen for scanner updates, for updates to a media, or for
+// updates to every media
+const (
+	socketTopicScanner socket.Topic = "scanner"
+	socketTopicMedias  socket.Topic = "medias"
+)
+
+func socketTopicMedia(hash string) socket.Topic {
+	return socket.Topic("media " + hash)
+}
+
+// eventTopics finds the topics a socket or sse client asked for in its params, and
+// whether it's allowed to listen for them
+func (s *Server) eventTopics(r *http.Request) ([]socket.Topic, bool) {
+	params := r.URL.Query()
+
+	var topics []socket.Topic
+	if want := params.Get("want_settings"); want != "" {
+		if _, ok := s.checkJWT(r); !ok {
+			return nil, false
+		}
+		topics = append(topics, socketTopicScanner)
+	}
+	if want := params.Get("want_media_hash"); want != "" {
+		topics = append(topics, socketTopicMedia(want))
+	}
+	if want := params.Get("want_all_media"); want != "" {
+		// events for every media would show members the media outside of their library,
+		// so only admins can listen for them
+		if userID, ok := s.checkJWT(r); ok {
+			r = withUserID(r, userID)
+		} else if key, ok := s.checkAPIKey(r); ok && key.Allows(db.APIKeyScopeRead) {
+			r = withAPIKey(r, key)
+		}
+		if requestCredential(r) == "" {
+			return nil, false
+		}
+		if library, err := s.requestLibrary(r); err != nil || library != 0 {
+			return nil, false
+		}
+		topics = append(topics, socketTopicMedias)
+	}
+	return topics, true
+}
+
+type SocketEventType string
+
+const (
+	SocketEventImportProgress SocketEventType = "import_progress"
+	SocketEventScanError      SocketEventType = "scan_error"
+	SocketEventMediaCreated   SocketEventType = "media_created"
+	SocketEventMediaProcessed SocketEventType = "media_processed"
+	SocketEventMediaDeleted   SocketEventType = "media_deleted"
+	SocketEventMediaRestored  SocketEventType = "media_restored"
+)
+
+// SocketEvent is the json sent to socket clients. only the fields for its type are set
+type SocketEvent struct {
+	Type     SocketEventType       `json:"type"`
+	Time     time.Time             `json:"time"`
+	Hash     string                `json:"hash,omitempty"`
+	FileName string                `json:"file_name,omitempty"`
+	Progress *SocketImportProgress `json:"progress,omitempty"`
+	Media    *SocketMediaSummary   `json:"media,omitempty"`
+	Trashed  bool                  `json:"trashed,omitempty"`
+	Error    string                `json:"error,omitempty"`
+}
+
+type SocketImportProgress struct {
+	Running        bool   `json:"running"`
+	CountTotal     int    `json:"count_total"`
+	CountProcessed int    `json:"count_processed"`
+	CountErrors    int    `json:"count_errors"`
+	LastHash       string `json:"last_hash"`
+}
+
+// SocketMediaSummary is a media without its text, since anyone who knows a media's
+// hash can listen for it
+type SocketMediaSummary struct {
+	Type        db.MediaType `json:"type"`
+	Timestamp   time.Time    `json:"timestamp"`
+	DimWidth    int          `json:"dim_width"`
+	DimHeight   int          `json:"dim_height"`
+	Processed   bool         `json:"processed"`
+	CountBlocks int          `json:"count_blocks"`
+}
+
+func (s *Server) SocketNotifyScannerUpdate() {
+	for range throttleChan(s.importerEvents.Progress(), 500*time.Millisecond, 2*time.Second) {
+		status := s.importer.Status()
+		s.publish(&SocketEvent{
+			Type: SocketEventImportProgress,
+			Progress: &SocketImportProgress{
+				Running:        status.Running,
+				CountTotal:     status.CountTotal,
+				CountProcessed: status.CountProcessed,
+				CountErrors:    len(status.Errors),
+				LastHash:       status.LastHash,
+			},
+		}, socketTopicScanner)
+	}
+}
+
+func (s *Server) SocketNotifyMedia() {
+	for event := range s.importerEvents.Events() {
+		switch event.Type {
+		case importer.EventScanError:
+			s.publish(&SocketEvent{
+				Type:     SocketEventScanError,
+				Time:     event.Time,
+				FileName: event.FileName,
+				Error:    event.Error.Error(),
+			}, socketTopicScanner)
+		case importer.EventMediaCreated:
+			s.publishMediaEvent(&SocketEvent{
+				Type:     SocketEventMediaCreated,
+				Time:     event.Time,
+				Hash:     event.Hash,
+				FileName: event.FileName,
+			})
+		case importer.EventMediaRestored:
+			s.publishMediaEvent(&SocketEvent{
+				Type:     SocketEventMediaRestored,
+				Time:     event.Time,
+				Hash:     event.Hash,
+				FileName: event.FileName,
+			})
+		case importer.EventMediaProcessed:
+			media, err := s.db.GetMediaByHashWithRelations(event.Hash, 0)
+			if err != nil {
+				log.Printf("error getting processed media %q: %v", event.Hash, err)
+				continue
+			}
+			s.publishMediaEvent(&SocketEvent{
+				Type:     SocketEventMediaProcessed,
+				Time:     event.Time,
+				Hash:     event.Hash,
+				FileName: event.FileName,
+				Media: &SocketMediaSummary{
+					Type:        media.Type,
+					Timestamp:   media.Timestamp,
+					DimWidth:    media.DimWidth,
+					DimHeight:   media.DimHeight,
+					Processed:   media.Processed,
+					CountBlocks: len(media.Blocks),
+				},
+			})
+		}
+	}
+}
+
+// publishMediaEvent tells the clients of a media, and of every media, about an event.
+// it doesn't block
+func (s *Server) publishMediaEvent(event *SocketEvent) {
+	s.publish(event, socketTopicMedia(event.Hash), socketTopicMedias)
+}
+
+func (s *Server) publish(event *SocketEvent, topics ...socket.Topic) {
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	msg, err := json.Marshal(event)
+	if err != nil {
+		log.Printf("error encoding socket event: %v", err)
+		return
+	}
+	s.socketHub.Publish(msg, topics...)
+	s.sseBroker.Publish(msg, topics...)
+}
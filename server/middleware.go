@@ -1,13 +1,24 @@
 package server
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"log"
+	"net"
 	"net/http"
+	"net/url"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/gorilla/handlers"
+	"github.com/gorilla/mux"
+	"github.com/jackc/pgx/v4"
 
+	"go.senan.xyz/socr/db"
 	"go.senan.xyz/socr/server/auth"
+	"go.senan.xyz/socr/server/ratelimit"
 	"go.senan.xyz/socr/server/resp"
 )
 
@@ -20,11 +31,13 @@ func (s *Server) WithCORS() func(http.Handler) http.Handler {
 	)
 }
 
+// WithJWT allows requests with a token, and adds the id of the token's user to the
+// request's context
 func (s *Server) WithJWT() func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			if checkJWT(s.hmacSecret, r) || checkJWTParam(s.hmacSecret, r) {
-				next.ServeHTTP(w, r)
+			if userID, ok := s.checkJWT(r); ok {
+				next.ServeHTTP(w, withUserID(r, userID))
 				return
 			}
 			resp.Errorf(w, http.StatusUnauthorized, "unauthorised")
@@ -32,23 +45,49 @@ func (s *Server) WithJWT() func(http.Handler) http.Handler {
 	}
 }
 
-func (s *Server) WithAPIKey() func(http.Handler) http.Handler {
+// WithAdmin allows requests from admins. it must come after WithJWT, or after
+// WithJWTOrAPIKey with the admin scope
+func (s *Server) WithAdmin() func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			if checkAPIKey(s.apiKey, r) {
+			userID, ok := requestUserID(r)
+			if _, isKey := requestAPIKey(r); isKey && !ok {
 				next.ServeHTTP(w, r)
 				return
 			}
-			resp.Errorf(w, http.StatusUnauthorized, "unauthorised")
+			user, err := s.db.GetUser(userID)
+			if errors.Is(err, pgx.ErrNoRows) {
+				resp.Errorf(w, http.StatusUnauthorized, "unauthorised")
+				return
+			}
+			if err != nil {
+				resp.Errorf(w, 500, "getting user: %v", err)
+				return
+			}
+			if !user.IsAdmin() {
+				resp.Errorf(w, http.StatusForbidden, "forbidden")
+				return
+			}
+			next.ServeHTTP(w, r)
 		})
 	}
 }
 
-func (s *Server) WithJWTOrAPIKey() func(http.Handler) http.Handler {
+// WithJWTOrAPIKey allows requests with a token, or with an api key which has scope.
+// the key, and its user if it has one, are added to the request's context
+func (s *Server) WithJWTOrAPIKey(scope db.APIKeyScope) func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			if checkAPIKey(s.apiKey, r) || checkJWT(s.hmacSecret, r) || checkJWTParam(s.hmacSecret, r) {
-				next.ServeHTTP(w, r)
+			if key, ok := s.checkAPIKey(r); ok {
+				if !key.Allows(scope) {
+					resp.Errorf(w, http.StatusForbidden, "api key needs scope %q", scope)
+					return
+				}
+				next.ServeHTTP(w, withAPIKey(r, key))
+				return
+			}
+			if userID, ok := s.checkJWT(r); ok {
+				next.ServeHTTP(w, withUserID(r, userID))
 				return
 			}
 			resp.Errorf(w, http.StatusUnauthorized, "unauthorised")
@@ -56,28 +95,275 @@ func (s *Server) WithJWTOrAPIKey() func(http.Handler) http.Handler {
 	}
 }
 
+// WithMediaVisibility hides private media and media in the trash from requests
+// without a token or an api key which can read. for requests with one, it hides media
+// outside of their library, and media in the trash which they can't restore
+func (s *Server) WithMediaVisibility() func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			hash := mux.Vars(r)["hash"]
+			if userID, ok := s.checkJWT(r); ok {
+				r = withUserID(r, userID)
+			} else if key, ok := s.checkAPIKey(r); ok && key.Allows(db.APIKeyScopeRead) {
+				r = withAPIKey(r, key)
+			}
+			if requestCredential(r) != "" {
+				library, err := s.requestLibrary(r)
+				if err != nil {
+					resp.Errorf(w, userErrorStatus(err), "getting user: %v", err)
+					return
+				}
+				ok, err := s.db.CanViewMedias(library, hash)
+				if err != nil {
+					resp.Errorf(w, 500, "checking media: %v", err)
+					return
+				}
+				if ok {
+					next.ServeHTTP(w, r)
+					return
+				}
+			}
+			public, err := s.db.IsMediaPublic(hash)
+			if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+				resp.Errorf(w, 500, "checking media: %v", err)
+				return
+			}
+			if !public {
+				resp.Errorf(w, http.StatusNotFound, "requested media not found")
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// WithMediaAccess allows requests whose user can see the media of the route's hash, or
+// change it if change is set. it must come after WithJWT or WithJWTOrAPIKey
+func (s *Server) WithMediaAccess(change bool) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if s.checkMediaAccess(w, r, change, mux.Vars(r)["hash"]) {
+				next.ServeHTTP(w, r)
+			}
+		})
+	}
+}
+
+// checkMediaAccess checks that the request's user can see the media of hashes, or
+// change them if change is set. if they can't, an error is written
+func (s *Server) checkMediaAccess(w http.ResponseWriter, r *http.Request, change bool, hashes ...string) bool {
+	library, err := s.requestLibrary(r)
+	if err != nil {
+		resp.Errorf(w, userErrorStatus(err), "getting user: %v", err)
+		return false
+	}
+	check, status := s.db.CanViewMedias, http.StatusNotFound
+	if change {
+		check, status = s.db.CanChangeMedias, http.StatusForbidden
+	}
+	ok, err := check(library, hashes...)
+	if err != nil {
+		resp.Errorf(w, 500, "checking media: %v", err)
+		return false
+	}
+	if !ok {
+		resp.Errorf(w, status, "requested media not found or not yours")
+		return false
+	}
+	return true
+}
+
+// requestLibrary is the library of the request's user, see SearchMediasOptions.Library.
+// it's 0, for every media, for admins and for api keys without a user
+func (s *Server) requestLibrary(r *http.Request) (db.UserID, error) {
+	userID, ok := requestUserID(r)
+	if !ok {
+		return 0, nil
+	}
+	user, err := s.db.GetUser(userID)
+	if err != nil {
+		return 0, err
+	}
+	if user.IsAdmin() {
+		return 0, nil
+	}
+	return user.ID, nil
+}
+
+// WithRateLimit limits requests by a key of each request, such as its ip. requests
+// with an empty key aren't limited
+func (s *Server) WithRateLimit(limiter *ratelimit.Limiter, key func(*http.Request) string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if k := key(r); k != "" {
+				if ok, wait := limiter.Allow(k); !ok {
+					tooManyRequests(w, wait)
+					return
+				}
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func tooManyRequests(w http.ResponseWriter, wait time.Duration) {
+	wait = wait.Round(time.Second) + time.Second
+	w.Header().Set("retry-after", strconv.Itoa(int(wait.Seconds())))
+	resp.Errorf(w, http.StatusTooManyRequests, "too many requests, try again in %v", wait)
+}
+
+// clientIP finds the ip of a request's client. requests from trusted proxies are from
+// the last ip in their x-forwarded-for which isn't a trusted proxy itself
+func (s *Server) clientIP(r *http.Request) string {
+	ip := remoteIP(r)
+	if ip == nil {
+		return r.RemoteAddr
+	}
+	if !s.isTrustedProxy(ip) {
+		return ip.String()
+	}
+	forwarded := strings.Split(r.Header.Get("x-forwarded-for"), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		forwardedIP := net.ParseIP(strings.TrimSpace(forwarded[i]))
+		if forwardedIP == nil {
+			break
+		}
+		ip = forwardedIP
+		if !s.isTrustedProxy(ip) {
+			break
+		}
+	}
+	return ip.String()
+}
+
+// remoteIP is the ip which a request came from directly, which may be a proxy
+func remoteIP(r *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return net.ParseIP(host)
+}
+
+func (s *Server) isTrustedProxy(ip net.IP) bool {
+	for _, proxy := range s.trustedProxies {
+		if proxy.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// requestCredential identifies the user or api key of a request which has been through
+// WithJWTOrAPIKey
+func requestCredential(r *http.Request) string {
+	if key, ok := requestAPIKey(r); ok {
+		return fmt.Sprintf("key %d", key.ID)
+	}
+	if userID, ok := requestUserID(r); ok {
+		return fmt.Sprintf("user %d", userID)
+	}
+	return ""
+}
+
 func (s *Server) WithLogging() func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			log.Printf("req %q", r.URL)
+			log.Printf("req %q", redactURL(r.URL))
 			next.ServeHTTP(w, r)
 		})
 	}
 }
 
-func checkAPIKey(apiKey string, r *http.Request) bool {
+// redactURL hides the secrets in a url's params, so that they aren't logged
+func redactURL(u *url.URL) *url.URL {
+	params := u.Query()
+	for _, key := range []string{"token", "password", "code"} {
+		if params.Has(key) {
+			params.Set(key, "redacted")
+		}
+	}
+	redacted := *u
+	redacted.RawQuery = params.Encode()
+	return &redacted
+}
+
+// checkAPIKey finds the api key of a request, and marks it as used
+func (s *Server) checkAPIKey(r *http.Request) (*db.APIKey, bool) {
 	header := r.Header.Get("x-api-key")
-	return apiKey != "" && header == apiKey
+	if header == "" {
+		return nil, false
+	}
+	key, err := s.db.UseAPIKey(auth.TokenHash(header))
+	if err != nil {
+		if !errors.Is(err, pgx.ErrNoRows) {
+			log.Printf("error using api key: %v", err)
+		}
+		return nil, false
+	}
+	return key, true
+}
+
+// checkJWT finds the user of a request's token, if it's valid and hasn't been revoked
+func (s *Server) checkJWT(r *http.Request) (db.UserID, bool) {
+	claims, err := auth.TokenParse(s.hmacSecret, requestToken(r))
+	if err != nil {
+		return 0, false
+	}
+	userID, err := strconv.Atoi(claims.Subject)
+	if err != nil {
+		return 0, false
+	}
+	valid, err := s.db.IsTokenValid(claims.ID, db.UserID(userID), claims.Issued())
+	if err != nil {
+		log.Printf("error checking token: %v", err)
+		return 0, false
+	}
+	if !valid {
+		return 0, false
+	}
+	return db.UserID(userID), true
+}
+
+// requestToken finds a request's token from its authorization header, or its token
+// param for requests which can't send headers
+func requestToken(r *http.Request) string {
+	token := r.Header.Get("authorization")
+	token = strings.TrimPrefix(token, "bearer ")
+	token = strings.TrimPrefix(token, "Bearer ")
+	if token == "" {
+		token = r.URL.Query().Get("token")
+	}
+	return token
+}
+
+type ctxKey int
+
+const (
+	ctxKeyUserID ctxKey = iota
+	ctxKeyAPIKey
+)
+
+func withUserID(r *http.Request, userID db.UserID) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), ctxKeyUserID, userID))
+}
+
+func withAPIKey(r *http.Request, key *db.APIKey) *http.Request {
+	r = r.WithContext(context.WithValue(r.Context(), ctxKeyAPIKey, key))
+	if key.UserID != nil {
+		r = withUserID(r, *key.UserID)
+	}
+	return r
 }
 
-func checkJWT(hmacSecret string, r *http.Request) bool {
-	header := r.Header.Get("authorization")
-	header = strings.TrimPrefix(header, "bearer ")
-	header = strings.TrimPrefix(header, "Bearer ")
-	return auth.TokenParse(hmacSecret, header) == nil
+// requestUserID finds the user of a request which has been through WithJWT or
+// WithJWTOrAPIKey. requests with the api key from the env have no user
+func requestUserID(r *http.Request) (db.UserID, bool) {
+	userID, ok := r.Context().Value(ctxKeyUserID).(db.UserID)
+	return userID, ok
 }
 
-func checkJWTParam(hmacSecret string, r *http.Request) bool {
-	param := r.URL.Query().Get("token")
-	return auth.TokenParse(hmacSecret, param) == nil
+func requestAPIKey(r *http.Request) (*db.APIKey, bool) {
+	key, ok := r.Context().Value(ctxKeyAPIKey).(*db.APIKey)
+	return key, ok
 }
@@ -0,0 +1,309 @@
+package oidc
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// flowExpiry is how long a user has to log in with the issuer
+const flowExpiry = 10 * time.Minute
+
+var ErrUnknownFlow = errors.New("unknown or expired login")
+
+// Provider logs users in with an openid connect issuer, using the authorization code
+// flow with pkce. the issuer is discovered when it's first needed
+type Provider struct {
+	issuer        string
+	clientID      string
+	clientSecret  string
+	redirectURL   string
+	usernameClaim string
+	client        *http.Client
+
+	mu        sync.Mutex
+	discovery *discovery
+	keys      map[string]*rsa.PublicKey
+	flows     map[string]*flow
+}
+
+type discovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// flow is the state of a login between redirecting to the issuer and its callback
+type flow struct {
+	nonce    string
+	verifier string
+	redirect string
+	created  time.Time
+}
+
+// Identity is a user who has logged in with the issuer. they are identified by issuer
+// and subject, since their username may change
+type Identity struct {
+	Issuer   string
+	Subject  string
+	Username string
+}
+
+// New makes a provider for issuer. usernameClaim is the id token claim used as the
+// socr username, such as preferred_username or email
+func New(issuer, clientID, clientSecret, redirectURL, usernameClaim string) *Provider {
+	return &Provider{
+		issuer:        issuer,
+		clientID:      clientID,
+		clientSecret:  clientSecret,
+		redirectURL:   redirectURL,
+		usernameClaim: usernameClaim,
+		client:        &http.Client{Timeout: 10 * time.Second},
+		flows:         map[string]*flow{},
+	}
+}
+
+// StartFlow starts a login, returning the issuer's url to send the user to. redirect
+// is remembered for when they come back
+func (p *Provider) StartFlow(ctx context.Context, redirect string) (string, error) {
+	disc, err := p.discover(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	var state, nonce, verifier string
+	for _, v := range []*string{&state, &nonce, &verifier} {
+		if *v, err = randomString(); err != nil {
+			return "", err
+		}
+	}
+
+	p.mu.Lock()
+	now := time.Now()
+	for k, f := range p.flows {
+		if now.Sub(f.created) > flowExpiry {
+			delete(p.flows, k)
+		}
+	}
+	p.flows[state] = &flow{nonce: nonce, verifier: verifier, redirect: redirect, created: now}
+	p.mu.Unlock()
+
+	challenge := sha256.Sum256([]byte(verifier))
+	params := url.Values{}
+	params.Set("response_type", "code")
+	params.Set("client_id", p.clientID)
+	params.Set("redirect_uri", p.redirectURL)
+	params.Set("scope", "openid profile email")
+	params.Set("state", state)
+	params.Set("nonce", nonce)
+	params.Set("code_challenge", base64.RawURLEncoding.EncodeToString(challenge[:]))
+	params.Set("code_challenge_method", "S256")
+
+	authURL, err := url.Parse(disc.AuthorizationEndpoint)
+	if err != nil {
+		return "", fmt.Errorf("parsing authorization endpoint: %w", err)
+	}
+	query := authURL.Query()
+	for k, v := range params {
+		query[k] = v
+	}
+	authURL.RawQuery = query.Encode()
+	return authURL.String(), nil
+}
+
+// FinishFlow finishes the login of a callback with state and code, returning who logged
+// in and the redirect the login was started with
+func (p *Provider) FinishFlow(ctx context.Context, state, code string) (*Identity, string, error) {
+	p.mu.Lock()
+	f, ok := p.flows[state]
+	delete(p.flows, state)
+	p.mu.Unlock()
+	if !ok || time.Since(f.created) > flowExpiry {
+		return nil, "", ErrUnknownFlow
+	}
+
+	disc, err := p.discover(ctx)
+	if err != nil {
+		return nil, "", err
+	}
+
+	params := url.Values{}
+	params.Set("grant_type", "authorization_code")
+	params.Set("code", code)
+	params.Set("redirect_uri", p.redirectURL)
+	params.Set("client_id", p.clientID)
+	params.Set("client_secret", p.clientSecret)
+	params.Set("code_verifier", f.verifier)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, disc.TokenEndpoint, strings.NewReader(params.Encode()))
+	if err != nil {
+		return nil, "", fmt.Errorf("making token request: %w", err)
+	}
+	req.Header.Set("content-type", "application/x-www-form-urlencoded")
+	req.Header.Set("accept", "application/json")
+
+	var token struct {
+		IDToken string `json:"id_token"`
+	}
+	if err := p.doJSON(req, &token); err != nil {
+		return nil, "", fmt.Errorf("exchanging code: %w", err)
+	}
+	if token.IDToken == "" {
+		return nil, "", fmt.Errorf("exchanging code: no id token")
+	}
+
+	identity, err := p.verify(ctx, disc, token.IDToken, f.nonce)
+	if err != nil {
+		return nil, "", fmt.Errorf("verifying id token: %w", err)
+	}
+	return identity, f.redirect, nil
+}
+
+func (p *Provider) verify(ctx context.Context, disc *discovery, idToken, nonce string) (*Identity, error) {
+	keyFunc := func(token *jwt.Token) (any, error) {
+		kid, _ := token.Header["kid"].(string)
+		return p.key(ctx, disc, kid)
+	}
+	var claims jwt.MapClaims
+	if _, err := jwt.ParseWithClaims(idToken, &claims, keyFunc, jwt.WithValidMethods([]string{"RS256", "RS384", "RS512"})); err != nil {
+		return nil, err
+	}
+	if !claims.VerifyIssuer(disc.Issuer, true) {
+		return nil, fmt.Errorf("unexpected issuer %v", claims["iss"])
+	}
+	if !claims.VerifyAudience(p.clientID, true) {
+		return nil, fmt.Errorf("unexpected audience %v", claims["aud"])
+	}
+	if !claims.VerifyExpiresAt(time.Now().Unix(), true) {
+		return nil, fmt.Errorf("expired")
+	}
+	if n, _ := claims["nonce"].(string); n != nonce {
+		return nil, fmt.Errorf("unexpected nonce")
+	}
+
+	subject, _ := claims["sub"].(string)
+	username, _ := claims[p.usernameClaim].(string)
+	if subject == "" || username == "" {
+		return nil, fmt.Errorf("needs a subject and a %q claim", p.usernameClaim)
+	}
+	return &Identity{Issuer: disc.Issuer, Subject: subject, Username: username}, nil
+}
+
+// key finds the issuer's signing key with id kid, fetching the issuer's keys again if
+// it's new, in case they have been rotated
+func (p *Provider) key(ctx context.Context, disc *discovery, kid string) (*rsa.PublicKey, error) {
+	p.mu.Lock()
+	key, ok := p.keys[kid]
+	p.mu.Unlock()
+	if ok {
+		return key, nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, disc.JWKSURI, nil)
+	if err != nil {
+		return nil, fmt.Errorf("making keys request: %w", err)
+	}
+	var jwks struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}
+	if err := p.doJSON(req, &jwks); err != nil {
+		return nil, fmt.Errorf("getting keys: %w", err)
+	}
+
+	keys := map[string]*rsa.PublicKey{}
+	for _, k := range jwks.Keys {
+		if k.Kty != "RSA" {
+			continue
+		}
+		n, errN := base64.RawURLEncoding.DecodeString(k.N)
+		e, errE := base64.RawURLEncoding.DecodeString(k.E)
+		if errN != nil || errE != nil {
+			continue
+		}
+		keys[k.Kid] = &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}
+	}
+
+	p.mu.Lock()
+	p.keys = keys
+	p.mu.Unlock()
+
+	key, ok = keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("unknown key %q", kid)
+	}
+	return key, nil
+}
+
+func (p *Provider) discover(ctx context.Context) (*discovery, error) {
+	p.mu.Lock()
+	disc := p.discovery
+	p.mu.Unlock()
+	if disc != nil {
+		return disc, nil
+	}
+
+	// the issuer is compared as it's given, but some have a trailing slash which isn't
+	// doubled up in their discovery url
+	discURL := strings.TrimSuffix(p.issuer, "/") + "/.well-known/openid-configuration"
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, discURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("making discovery request: %w", err)
+	}
+	disc = &discovery{}
+	if err := p.doJSON(req, disc); err != nil {
+		return nil, fmt.Errorf("discovering issuer: %w", err)
+	}
+	if disc.Issuer != p.issuer {
+		return nil, fmt.Errorf("discovering issuer: unexpected issuer %q", disc.Issuer)
+	}
+
+	p.mu.Lock()
+	p.discovery = disc
+	p.mu.Unlock()
+	return disc, nil
+}
+
+func (p *Provider) doJSON(req *http.Request, dest any) error {
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(dest); err != nil {
+		return fmt.Errorf("decoding response: %w", err)
+	}
+	return nil
+}
+
+func randomString() (string, error) {
+	raw := make([]byte, 24)
+	if _, err := rand.Read(raw); err != nil {
+		return "", fmt.Errorf("reading random: %w", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(raw), nil
+}
@@ -0,0 +1,185 @@
+package oidc_test
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+
+	"go.senan.xyz/socr/server/oidc"
+)
+
+// mockIssuer is an openid connect issuer which logs in everyone as username, after
+// checking their pkce verifier. its identifier is id, which is its url unless changed
+type mockIssuer struct {
+	*httptest.Server
+	id        string
+	key       *rsa.PrivateKey
+	username  string
+	nonce     string
+	challenge string
+}
+
+func newMockIssuer(t *testing.T, username string) *mockIssuer {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("generating key: %v", err)
+	}
+	m := &mockIssuer{key: key, username: username}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 m.id,
+			"authorization_endpoint": m.URL + "/auth",
+			"token_endpoint":         m.URL + "/token",
+			"jwks_uri":               m.URL + "/keys",
+		})
+	})
+	mux.HandleFunc("/keys", func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(map[string]any{
+			"keys": []map[string]string{{
+				"kty": "RSA",
+				"kid": "a",
+				"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+			}},
+		})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		verifier := sha256.Sum256([]byte(r.FormValue("code_verifier")))
+		if r.FormValue("code") != "code" || base64.RawURLEncoding.EncodeToString(verifier[:]) != m.challenge {
+			http.Error(w, "bad code", http.StatusBadRequest)
+			return
+		}
+		token := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+			"iss":                m.id,
+			"aud":                "socr",
+			"sub":                "subject",
+			"exp":                time.Now().Add(time.Minute).Unix(),
+			"nonce":              m.nonce,
+			"preferred_username": m.username,
+		})
+		token.Header["kid"] = "a"
+		signed, _ := token.SignedString(key)
+		_ = json.NewEncoder(w).Encode(map[string]string{"id_token": signed})
+	})
+	m.Server = httptest.NewServer(mux)
+	m.id = m.URL
+	t.Cleanup(m.Close)
+	return m
+}
+
+func TestFlow(t *testing.T) {
+	issuer := newMockIssuer(t, "alice")
+	provider := oidc.New(issuer.URL, "socr", "secret", "http://socr/callback", "preferred_username")
+
+	ctx := context.Background()
+	authURL, err := provider.StartFlow(ctx, "/search")
+	if err != nil {
+		t.Fatalf("starting flow: %v", err)
+	}
+	parsed, err := url.Parse(authURL)
+	if err != nil {
+		t.Fatalf("parsing auth url: %v", err)
+	}
+	params := parsed.Query()
+	issuer.nonce = params.Get("nonce")
+	issuer.challenge = params.Get("code_challenge")
+
+	if _, _, err := provider.FinishFlow(ctx, "not the state", "code"); err == nil {
+		t.Errorf("expected error finishing flow with unknown state")
+	}
+
+	identity, redirect, err := provider.FinishFlow(ctx, params.Get("state"), "code")
+	if err != nil {
+		t.Fatalf("finishing flow: %v", err)
+	}
+	if identity.Username != "alice" {
+		t.Errorf("username %q expected %q", identity.Username, "alice")
+	}
+	if identity.Issuer != issuer.URL || identity.Subject != "subject" {
+		t.Errorf("identity %q %q expected %q %q", identity.Issuer, identity.Subject, issuer.URL, "subject")
+	}
+	if redirect != "/search" {
+		t.Errorf("redirect %q expected %q", redirect, "/search")
+	}
+
+	if _, _, err := provider.FinishFlow(ctx, params.Get("state"), "code"); err == nil {
+		t.Errorf("expected error finishing flow twice")
+	}
+}
+
+func TestFlowWrongNonce(t *testing.T) {
+	issuer := newMockIssuer(t, "alice")
+	provider := oidc.New(issuer.URL, "socr", "secret", "http://socr/callback", "preferred_username")
+
+	ctx := context.Background()
+	authURL, err := provider.StartFlow(ctx, "")
+	if err != nil {
+		t.Fatalf("starting flow: %v", err)
+	}
+	parsed, _ := url.Parse(authURL)
+	params := parsed.Query()
+	issuer.nonce = "not the nonce"
+	issuer.challenge = params.Get("code_challenge")
+
+	if _, _, err := provider.FinishFlow(ctx, params.Get("state"), "code"); err == nil {
+		t.Errorf("expected error finishing flow with wrong nonce")
+	}
+}
+
+func TestFlowIssuerTrailingSlash(t *testing.T) {
+	tcases := []struct {
+		name       string
+		id         string // the issuer's identifier, relative to its url
+		configured string // the issuer socr is configured with, relative to its url
+		valid      bool
+	}{
+		{name: "with slash", id: "/", configured: "/", valid: true},
+		{name: "without slash", id: "", configured: "", valid: true},
+		{name: "slash not configured", id: "/", configured: "", valid: false},
+		{name: "slash configured", id: "", configured: "/", valid: false},
+	}
+	for _, tcase := range tcases {
+		t.Run(tcase.name, func(t *testing.T) {
+			issuer := newMockIssuer(t, "alice")
+			issuer.id = issuer.URL + tcase.id
+			provider := oidc.New(issuer.URL+tcase.configured, "socr", "secret", "http://socr/callback", "preferred_username")
+
+			ctx := context.Background()
+			authURL, err := provider.StartFlow(ctx, "")
+			if !tcase.valid {
+				if err == nil {
+					t.Errorf("expected error starting flow")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("starting flow: %v", err)
+			}
+			parsed, _ := url.Parse(authURL)
+			params := parsed.Query()
+			issuer.nonce = params.Get("nonce")
+			issuer.challenge = params.Get("code_challenge")
+
+			identity, _, err := provider.FinishFlow(ctx, params.Get("state"), "code")
+			if err != nil {
+				t.Fatalf("finishing flow: %v", err)
+			}
+			if identity.Issuer != issuer.id {
+				t.Errorf("issuer %q expected %q", identity.Issuer, issuer.id)
+			}
+		})
+	}
+}
@@ -0,0 +1,194 @@
+package ratelimit
+
+import (
+	"sync"
+	"time"
+)
+
+// sweepInterval is how often keys which don't need remembering are forgotten
+const sweepInterval = time.Minute
+
+// Limiter is a token bucket rate limiter for many keys, such as ips or usernames. each
+// key may make burst requests at once, refilled at perMinute
+type Limiter struct {
+	mu        sync.Mutex
+	perMinute float64
+	burst     float64
+	buckets   map[string]*bucket
+	lastSweep time.Time
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// New makes a limiter, or returns nil if perMinute is 0. a nil limiter allows
+// everything
+func New(perMinute, burst int) *Limiter {
+	if perMinute <= 0 {
+		return nil
+	}
+	if burst <= 0 {
+		burst = perMinute
+	}
+	return &Limiter{
+		perMinute: float64(perMinute),
+		burst:     float64(burst),
+		buckets:   map[string]*bucket{},
+	}
+}
+
+// Allow takes a token for key. if there are none left, it returns how long until
+// there will be
+func (l *Limiter) Allow(key string) (bool, time.Duration) {
+	if l == nil {
+		return true, 0
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	l.sweep(now)
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = l.refill(b, now)
+	b.last = now
+	if b.tokens < 1 {
+		wait := time.Duration((1 - b.tokens) / l.perMinute * float64(time.Minute))
+		return false, wait
+	}
+	b.tokens--
+	return true, 0
+}
+
+func (l *Limiter) refill(b *bucket, now time.Time) float64 {
+	tokens := b.tokens + now.Sub(b.last).Minutes()*l.perMinute
+	if tokens > l.burst {
+		return l.burst
+	}
+	return tokens
+}
+
+// sweep forgets full buckets, which are the same as new ones
+func (l *Limiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < sweepInterval {
+		return
+	}
+	l.lastSweep = now
+	for key, b := range l.buckets {
+		if l.refill(b, now) >= l.burst {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// Lockout locks keys out after too many failures, such as failed logins. each failure
+// after attempts doubles the lock, starting at base up to max
+type Lockout struct {
+	mu        sync.Mutex
+	attempts  int
+	base, max time.Duration
+	entries   map[string]*lockoutEntry
+	lastSweep time.Time
+}
+
+type lockoutEntry struct {
+	failures int
+	until    time.Time
+	last     time.Time
+}
+
+// NewLockout makes a lockout, or returns nil if attempts is 0. a nil lockout never
+// locks
+func NewLockout(attempts int, base, max time.Duration) *Lockout {
+	if attempts <= 0 {
+		return nil
+	}
+	return &Lockout{
+		attempts: attempts,
+		base:     base,
+		max:      max,
+		entries:  map[string]*lockoutEntry{},
+	}
+}
+
+// Locked returns how long key is still locked for
+func (l *Lockout) Locked(key string) (time.Duration, bool) {
+	if l == nil {
+		return 0, false
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	e, ok := l.entries[key]
+	if !ok {
+		return 0, false
+	}
+	if wait := time.Until(e.until); wait > 0 {
+		return wait, true
+	}
+	return 0, false
+}
+
+// Fail records a failure for key, locking it if it has failed too many times
+func (l *Lockout) Fail(key string) {
+	if l == nil {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	l.sweep(now)
+
+	e, ok := l.entries[key]
+	if !ok {
+		e = &lockoutEntry{}
+		l.entries[key] = e
+	}
+	e.failures++
+	e.last = now
+	if over := e.failures - l.attempts; over >= 0 {
+		lock := l.base
+		for i := 0; i < over && lock < l.max; i++ {
+			lock *= 2
+		}
+		if lock > l.max {
+			lock = l.max
+		}
+		e.until = now.Add(lock)
+	}
+}
+
+// Reset forgets the failures of key, such as after a successful login
+func (l *Lockout) Reset(key string) {
+	if l == nil {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	delete(l.entries, key)
+}
+
+// sweep forgets keys which haven't failed for longer than the longest lock
+func (l *Lockout) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < sweepInterval {
+		return
+	}
+	l.lastSweep = now
+	for key, e := range l.entries {
+		if now.Sub(e.last) > l.max && now.After(e.until) {
+			delete(l.entries, key)
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package ratelimit_test
+
+import (
+	"testing"
+	"time"
+
+	"go.senan.xyz/socr/server/ratelimit"
+)
+
+func TestLimiter(t *testing.T) {
+	limiter := ratelimit.New(1, 3)
+	for i := 0; i < 3; i++ {
+		if ok, _ := limiter.Allow("a"); !ok {
+			t.Fatalf("request %d not allowed in burst", i)
+		}
+	}
+	ok, wait := limiter.Allow("a")
+	if ok {
+		t.Errorf("request allowed after burst")
+	}
+	if wait <= 0 || wait > time.Minute {
+		t.Errorf("wait %v expected up to a minute", wait)
+	}
+	if ok, _ := limiter.Allow("b"); !ok {
+		t.Errorf("other key not allowed")
+	}
+
+	disabled := ratelimit.New(0, 0)
+	for i := 0; i < 10; i++ {
+		if ok, _ := disabled.Allow("a"); !ok {
+			t.Fatalf("disabled limiter didn't allow request %d", i)
+		}
+	}
+}
+
+func TestLockout(t *testing.T) {
+	lockout := ratelimit.NewLockout(2, time.Minute, 4*time.Minute)
+
+	tcases := []struct {
+		locked  bool
+		waitMin time.Duration
+	}{
+		{locked: false},
+		{locked: true, waitMin: 59 * time.Second},
+		{locked: true, waitMin: 119 * time.Second},
+		{locked: true, waitMin: 239 * time.Second},
+		{locked: true, waitMin: 239 * time.Second}, // capped at max
+	}
+	for i, tcase := range tcases {
+		lockout.Fail("a")
+		wait, locked := lockout.Locked("a")
+		if locked != tcase.locked {
+			t.Errorf("failure %d locked %t expected %t", i+1, locked, tcase.locked)
+		}
+		if wait < tcase.waitMin || wait > 4*time.Minute {
+			t.Errorf("failure %d wait %v expected at least %v", i+1, wait, tcase.waitMin)
+		}
+	}
+
+	if _, locked := lockout.Locked("b"); locked {
+		t.Errorf("other key locked")
+	}
+	lockout.Reset("a")
+	if _, locked := lockout.Locked("a"); locked {
+		t.Errorf("key locked after reset")
+	}
+}
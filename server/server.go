@@ -3,18 +3,22 @@ package server
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/gorilla/websocket"
+	"github.com/jackc/pgx/v4"
 
 	"go.senan.xyz/socr"
 	"go.senan.xyz/socr/db"
@@ -22,7 +26,11 @@ import (
 	"go.senan.xyz/socr/imagery"
 	"go.senan.xyz/socr/importer"
 	"go.senan.xyz/socr/server/auth"
+	"go.senan.xyz/socr/server/oidc"
+	"go.senan.xyz/socr/server/ratelimit"
 	"go.senan.xyz/socr/server/resp"
+	"go.senan.xyz/socr/server/socket"
+	"go.senan.xyz/socr/server/sse"
 	"go.senan.xyz/socr/web"
 )
 
@@ -32,65 +40,174 @@ type Server struct {
 	directoriesUploadsAlias string
 	socketUpgrader          websocket.Upgrader
 	importer                *importer.Importer
-	socketClientsScanner    map[*websocket.Conn]struct{}
-	socketClientsImporter   map[string]map[*websocket.Conn]struct{}
+	socketHub               *socket.Hub
+	sseBroker               *sse.Broker
 	hmacSecret              string
-	loginUsername           string
-	loginPassword           string
-	apiKey                  string
-	socketMedias            chan string
-	socketScannerUpdates    chan struct{}
+	trustedProxies          []*net.IPNet
+	limiterIP               *ratelimit.Limiter
+	limiterLogin            *ratelimit.Limiter
+	limiterUpload           *ratelimit.Limiter
+	loginLockout            *ratelimit.Lockout
+	authHeader              string
+	oidc                    *oidc.Provider
+	createUsers             bool
+	importerEvents          *importer.Subscription
 }
 
-func New(db *db.DB, importr *importer.Importer, directories directories.Directories, uploadsAlias string, hmacSecret, loginUsername, loginPassword, apkKey string) *Server {
+func New(db *db.DB, importr *importer.Importer, directories directories.Directories, uploadsAlias string, hmacSecret string, limits Limits, external ExternalAuth) *Server {
 	servr := &Server{
 		db:                      db,
 		directories:             directories,
 		directoriesUploadsAlias: uploadsAlias,
 		socketUpgrader:          websocket.Upgrader{CheckOrigin: CheckOrigin},
 		importer:                importr,
-		socketClientsScanner:    map[*websocket.Conn]struct{}{},
-		socketClientsImporter:   map[string]map[*websocket.Conn]struct{}{},
+		socketHub:               socket.NewHub(),
+		sseBroker:               sse.NewBroker(sseHistory),
 		hmacSecret:              hmacSecret,
-		loginUsername:           loginUsername,
-		loginPassword:           loginPassword,
-		apiKey:                  apkKey,
-		socketMedias:            make(chan string),
-		socketScannerUpdates:    make(chan struct{}),
-	}
-	importr.AddNotifyMediaFunc(func(hash string) {
-		servr.socketMedias <- hash
-	})
-	importr.AddNotifyProgressFunc(func() {
-		servr.socketScannerUpdates <- struct{}{}
-	})
+		trustedProxies:          limits.TrustedProxies,
+		limiterIP:               ratelimit.New(limits.IP, limits.IP),
+		limiterLogin:            ratelimit.New(limits.Login, limits.Login),
+		limiterUpload:           ratelimit.New(limits.Upload, limits.Upload),
+		loginLockout:            ratelimit.NewLockout(limits.LoginAttempts, loginLockoutBase, loginLockoutMax),
+		authHeader:              external.Header,
+		oidc:                    external.OIDC,
+		createUsers:             external.CreateUsers,
+		importerEvents:          importr.Subscribe(importerEventsQueue),
+	}
 	return servr
 }
 
+// Limits are the rate limits of a server, in requests per minute. 0 disables a limit
+type Limits struct {
+	IP             int          // any request, for each ip
+	Login          int          // logins, for each ip and for each username
+	Upload         int          // uploads, for each user or api key
+	LoginAttempts  int          // failed logins before an ip is locked out of a username
+	TrustedProxies []*net.IPNet // proxies whose x-forwarded-for can be trusted for client ips
+}
+
+// ExternalAuth configures logging in without a socr password. either way, users get
+// the same tokens as they would by logging in with a password
+type ExternalAuth struct {
+	Header      string         // a header with the username, from trusted proxies only
+	OIDC        *oidc.Provider // an openid connect issuer, or nil
+	CreateUsers bool           // whether unknown usernames are created as members
+}
+
+// logins are locked out for loginLockoutBase after too many failures, doubling with
+// each failure after that up to loginLockoutMax
+const (
+	loginLockoutBase = time.Minute
+	loginLockoutMax  = time.Hour
+)
+
 func (s *Server) Router() *mux.Router {
 	// begin normal routes
 	r := mux.NewRouter()
 	r.Use(s.WithCORS())
 	r.Use(s.WithLogging())
-	r.HandleFunc("/api/authenticate", s.serveAuthenticate)
-	r.HandleFunc("/api/media/{hash}/raw", s.serveMediaRaw)
-	r.HandleFunc("/api/media/{hash}/thumb", s.serveMediaThumb)
-	r.HandleFunc("/api/media/{hash}", s.serveMedia)
+	r.Use(s.WithRateLimit(s.limiterIP, s.clientIP))
 	r.HandleFunc("/api/websocket", s.serveWebSocket)
+	r.HandleFunc("/api/events", s.serveEvents).Methods(http.MethodGet)
+	r.HandleFunc("/api/authenticate/methods", s.serveAuthenticateMethods)
+
+	// begin login routes, which are limited more than others
+	rLogin := r.NewRoute().Subrouter()
+	rLogin.Use(s.WithRateLimit(s.limiterLogin, s.clientIP))
+	rLogin.HandleFunc("/api/authenticate", s.serveAuthenticate)
+	rLogin.HandleFunc("/api/refresh", s.serveRefresh).Methods(http.MethodPost)
+	rLogin.HandleFunc("/api/authenticate/header", s.serveAuthenticateHeader).Methods(http.MethodPost)
+	rLogin.HandleFunc("/api/oidc/login", s.serveOIDCLogin)
+	rLogin.HandleFunc("/api/oidc/callback", s.serveOIDCCallback)
+
+	// begin public media routes, which hide private and trashed media from the public
+	rMedia := r.NewRoute().Subrouter()
+	rMedia.Use(s.WithMediaVisibility())
+	rMedia.HandleFunc("/api/media/{hash}/raw", s.serveMediaRaw)
+	rMedia.HandleFunc("/api/media/{hash}/thumb", s.serveMediaThumb)
+	rMedia.HandleFunc("/api/media/{hash}", s.serveMedia).Methods(http.MethodGet)
+
+	// begin share routes, which resolve share tokens to the media they share
+	r.HandleFunc("/api/share/{token}", s.serveShareMedia)
+	r.HandleFunc("/api/share/{token}/raw", s.serveShareRaw)
+	r.HandleFunc("/api/share/{token}/thumb", s.serveShareThumb)
 
-	// begin authenticated routes
+	// begin read routes, for users and api keys which can read
+	rRead := r.NewRoute().Subrouter()
+	rRead.Use(s.WithJWTOrAPIKey(db.APIKeyScopeRead))
+	rRead.HandleFunc("/api/ping", s.servePing)
+	rRead.HandleFunc("/api/directories", s.serveDirectories)
+	rRead.HandleFunc("/api/import_status", s.serveImportStatus)
+	rRead.HandleFunc("/api/search", s.serveSearch)
+	rRead.HandleFunc("/api/tags", s.serveTags)
+	rRead.HandleFunc("/api/collections", s.serveCollections).Methods(http.MethodGet)
+	rRead.HandleFunc("/api/collections/{id}", s.serveCollection).Methods(http.MethodGet)
+
+	// begin authenticated routes, for users but not api keys
 	rJWT := r.NewRoute().Subrouter()
 	rJWT.Use(s.WithJWT())
-	rJWT.HandleFunc("/api/ping", s.servePing)
-	rJWT.HandleFunc("/api/start_import", s.serveStartImport)
-	rJWT.HandleFunc("/api/about", s.serveAbout)
-	rJWT.HandleFunc("/api/directories", s.serveDirectories)
-	rJWT.HandleFunc("/api/import_status", s.serveImportStatus)
-	rJWT.HandleFunc("/api/search", s.serveSearch)
+	rJWT.HandleFunc("/api/me", s.serveMe)
+	rJWT.HandleFunc("/api/logout", s.serveLogout).Methods(http.MethodPost)
+	rJWT.HandleFunc("/api/logout_all", s.serveLogoutAll).Methods(http.MethodPost)
+	rJWT.HandleFunc("/api/api_keys", s.serveAPIKeys).Methods(http.MethodGet)
+	rJWT.HandleFunc("/api/api_keys", s.serveAPIKeyCreate).Methods(http.MethodPost)
+	rJWT.HandleFunc("/api/api_keys/{id}", s.serveAPIKeyDelete).Methods(http.MethodDelete)
+
+	// begin write routes, for users and admin api keys
+	rWrite := r.NewRoute().Subrouter()
+	rWrite.Use(s.WithJWTOrAPIKey(db.APIKeyScopeAdmin))
+	rWrite.HandleFunc("/api/tags/add", s.serveTagsAdd)
+	rWrite.HandleFunc("/api/tags/remove", s.serveTagsRemove)
+	rWrite.HandleFunc("/api/media/delete", s.serveMediasDelete).Methods(http.MethodPost)
+	rWrite.HandleFunc("/api/trash", s.serveTrash).Methods(http.MethodGet)
+	rWrite.HandleFunc("/api/trash/restore", s.serveTrashRestore).Methods(http.MethodPost)
+	rWrite.HandleFunc("/api/shares", s.serveShares).Methods(http.MethodGet)
+	rWrite.HandleFunc("/api/shares", s.serveShareCreate).Methods(http.MethodPost)
+	rWrite.HandleFunc("/api/shares/{id}", s.serveShareDelete).Methods(http.MethodDelete)
+	rWrite.HandleFunc("/api/collections", s.serveCollectionCreate).Methods(http.MethodPost)
+	rWrite.HandleFunc("/api/collections/{id}", s.serveCollectionUpdate).Methods(http.MethodPut)
+	rWrite.HandleFunc("/api/collections/{id}", s.serveCollectionDelete).Methods(http.MethodDelete)
+	rWrite.HandleFunc("/api/collections/{id}/add", s.serveCollectionAdd)
+	rWrite.HandleFunc("/api/collections/{id}/remove", s.serveCollectionRemove)
+	rWrite.HandleFunc("/api/collections/{id}/reorder", s.serveCollectionReorder)
+
+	// begin media routes, for users who can see the route's media
+	rMediaView := rWrite.NewRoute().Subrouter()
+	rMediaView.Use(s.WithMediaAccess(false))
+	rMediaView.HandleFunc("/api/media/{hash}/star", s.serveMediaStar).Methods(http.MethodPut)
+	rMediaView.HandleFunc("/api/media/{hash}/star", s.serveMediaUnstar).Methods(http.MethodDelete)
+
+	// begin media routes, for users who can change the route's media
+	rMediaChange := rWrite.NewRoute().Subrouter()
+	rMediaChange.Use(s.WithMediaAccess(true))
+	rMediaChange.HandleFunc("/api/media/{hash}", s.serveMediaDelete).Methods(http.MethodDelete)
+	rMediaChange.HandleFunc("/api/media/{hash}/note", s.serveMediaNote).Methods(http.MethodPut)
+	rMediaChange.HandleFunc("/api/media/{hash}/blocks", s.serveBlockCreate).Methods(http.MethodPost)
+	rMediaChange.HandleFunc("/api/media/{hash}/blocks/{id}", s.serveBlockUpdate).Methods(http.MethodPut)
+	rMediaChange.HandleFunc("/api/media/{hash}/blocks/{id}", s.serveBlockDelete).Methods(http.MethodDelete)
+	rMediaChange.HandleFunc("/api/media/{hash}/reprocess", s.serveMediaReprocess).Methods(http.MethodPost)
+	rMediaChange.HandleFunc("/api/media/{hash}/visibility", s.serveMediaVisibility).Methods(http.MethodPut)
+	rMediaChange.HandleFunc("/api/media/{hash}/tags/{tag}", s.serveMediaTagAdd).Methods(http.MethodPut)
+	rMediaChange.HandleFunc("/api/media/{hash}/tags/{tag}", s.serveMediaTagRemove).Methods(http.MethodDelete)
+
+	// begin admin routes
+	rAdmin := r.NewRoute().Subrouter()
+	rAdmin.Use(s.WithJWTOrAPIKey(db.APIKeyScopeAdmin))
+	rAdmin.Use(s.WithAdmin())
+	rAdmin.HandleFunc("/api/start_import", s.serveStartImport)
+	rAdmin.HandleFunc("/api/about", s.serveAbout)
+	rAdmin.HandleFunc("/api/directories/{alias}/visibility", s.serveDirectoryVisibility).Methods(http.MethodPut)
+	rAdmin.HandleFunc("/api/trash/empty", s.serveTrashEmpty).Methods(http.MethodPost)
+	rAdmin.HandleFunc("/api/tags/rename", s.serveTagRename)
+	rAdmin.HandleFunc("/api/users", s.serveUsers).Methods(http.MethodGet)
+	rAdmin.HandleFunc("/api/users", s.serveUserCreate).Methods(http.MethodPost)
+	rAdmin.HandleFunc("/api/users/{id}", s.serveUserUpdate).Methods(http.MethodPut)
+	rAdmin.HandleFunc("/api/users/{id}", s.serveUserDelete).Methods(http.MethodDelete)
 
 	// begin api key routes
 	rAPIKey := r.NewRoute().Subrouter()
-	rAPIKey.Use(s.WithJWTOrAPIKey())
+	rAPIKey.Use(s.WithJWTOrAPIKey(db.APIKeyScopeUpload))
+	rAPIKey.Use(s.WithRateLimit(s.limiterUpload, requestCredential))
 	rAPIKey.HandleFunc("/api/upload", s.serveUpload)
 
 	// frontend routes
@@ -100,7 +217,11 @@ func (s *Server) Router() *mux.Router {
 	r.Handle("/{f}.woff2", dist)
 	r.Handle("/favicon.ico", dist)
 	r.Handle("/i/{hash}", openGraphReplacer("index.html", string(web.Index), func(r *http.Request) openGraphContent {
-		media, _ := s.db.GetMediaByHash(mux.Vars(r)["hash"])
+		hash := mux.Vars(r)["hash"]
+		if public, _ := s.db.IsMediaPublic(hash); !public {
+			return openGraphContent{}
+		}
+		media, _ := s.db.GetMediaByHash(hash)
 		if media == nil {
 			return openGraphContent{}
 		}
@@ -110,37 +231,29 @@ func (s *Server) Router() *mux.Router {
 			height: media.DimHeight,
 		}
 	}))
+	r.Handle("/s/{token}", openGraphReplacer("index.html", string(web.Index), func(r *http.Request) openGraphContent {
+		// shares with a password or a view limit get no preview, since crawlers can't
+		// give the password and would use up the views
+		token := mux.Vars(r)["token"]
+		share, _ := s.db.GetShareByToken(token)
+		if share == nil || share.HasPassword || share.MaxViews != nil {
+			return openGraphContent{}
+		}
+		media, _ := s.db.GetMediaByHash(share.MediaHash)
+		if media == nil {
+			return openGraphContent{}
+		}
+		return openGraphContent{
+			link:   joinPath(forwardedBaseURL(r), fmt.Sprintf("/api/share/%s/raw", token)),
+			width:  media.DimWidth,
+			height: media.DimHeight,
+		}
+	}))
 	r.Handle("/", dist)
 	r.NotFoundHandler = http.RedirectHandler("/", http.StatusSeeOther)
 	return r
 }
 
-func (s *Server) SocketNotifyScannerUpdate() {
-	for range throttleChan(s.socketScannerUpdates, 500*time.Millisecond, 2*time.Second) {
-		for client := range s.socketClientsScanner {
-			if err := client.WriteMessage(websocket.TextMessage, []byte(nil)); err != nil {
-				log.Printf("error writing to socket client: %v", err)
-				client.Close()
-				delete(s.socketClientsScanner, client)
-				continue
-			}
-		}
-	}
-}
-
-func (s *Server) SocketNotifyMedia() {
-	for hash := range s.socketMedias {
-		for client := range s.socketClientsImporter[hash] {
-			if err := client.WriteMessage(websocket.TextMessage, []byte(nil)); err != nil {
-				log.Printf("error writing to socket client: %v", err)
-				client.Close()
-				delete(s.socketClientsImporter[hash], client)
-				continue
-			}
-		}
-	}
-}
-
 func (s *Server) servePing(w http.ResponseWriter, r *http.Request) {
 	resp.Write(w, struct {
 		Status string `json:"status"`
@@ -176,9 +289,15 @@ func (s *Server) serveUpload(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// uploads with an api key have no owner, and so are in every user's library
+	var owner *db.UserID
+	if userID, ok := requestUserID(r); ok {
+		owner = &userID
+	}
+
 	go func() {
 		timestamp := time.Now()
-		if err := s.importer.ImportMedia(media, s.directoriesUploadsAlias, fileName, timestamp); err != nil {
+		if err := s.importer.ImportMedia(media, s.directoriesUploadsAlias, fileName, timestamp, owner); err != nil {
 			log.Printf("error processing media %s: %v", media.Hash(), err)
 			return
 		}
@@ -203,8 +322,7 @@ func (s *Server) serveStartImport(w http.ResponseWriter, r *http.Request) {
 func (s *Server) serveAbout(w http.ResponseWriter, r *http.Request) {
 	settings := map[string]interface{}{
 		"version":        socr.Version,
-		"api key":        s.apiKey,
-		"socket clients": len(s.socketClientsScanner),
+		"socket clients": s.socketHub.Count(socketTopicScanner) + s.sseBroker.Count(socketTopicScanner),
 	}
 	for alias, path := range s.directories {
 		key := fmt.Sprintf("directory %q", alias)
@@ -242,6 +360,10 @@ func (s *Server) serveMediaRaw(w http.ResponseWriter, r *http.Request) {
 		resp.Errorf(w, http.StatusBadRequest, "no media hash provided")
 		return
 	}
+	s.serveRaw(w, r, hash)
+}
+
+func (s *Server) serveRaw(w http.ResponseWriter, r *http.Request, hash string) {
 	row, err := s.db.GetDirInfoByMediaHash(hash)
 	if err != nil {
 		resp.Errorf(w, http.StatusBadRequest, "requested media not found: %v", err)
@@ -262,6 +384,10 @@ func (s *Server) serveMediaThumb(w http.ResponseWriter, r *http.Request) {
 		resp.Errorf(w, http.StatusBadRequest, "no media hash provided")
 		return
 	}
+	s.serveThumb(w, r, hash)
+}
+
+func (s *Server) serveThumb(w http.ResponseWriter, r *http.Request, hash string) {
 	row, err := s.db.GetThumbnailByMediaHash(hash)
 	if err != nil {
 		resp.Errorf(w, http.StatusBadRequest, "requested media not found: %v", err)
@@ -277,7 +403,9 @@ func (s *Server) serveMedia(w http.ResponseWriter, r *http.Request) {
 		resp.Errorf(w, http.StatusBadRequest, "no media hash provided")
 		return
 	}
-	media, err := s.db.GetMediaByHashWithRelations(hash)
+	// the media route is public, so there may not be a user
+	userID, _ := requestUserID(r)
+	media, err := s.db.GetMediaByHashWithRelations(hash, userID)
 	if err != nil {
 		resp.Errorf(w, http.StatusBadRequest, "requested media not found: %v", err)
 		return
@@ -285,18 +413,373 @@ func (s *Server) serveMedia(w http.ResponseWriter, r *http.Request) {
 	resp.Write(w, media)
 }
 
+type ServeMediasDeletePayload struct {
+	Hashes      []string `json:"hashes"`
+	Permanent   bool     `json:"permanent"`
+	DeleteFiles bool     `json:"delete_files"`
+}
+
+func (s *Server) serveMediasDelete(w http.ResponseWriter, r *http.Request) {
+	var payload ServeMediasDeletePayload
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		resp.Errorf(w, http.StatusBadRequest, "decode payload: %v", err)
+		return
+	}
+	if len(payload.Hashes) == 0 {
+		resp.Errorf(w, http.StatusBadRequest, "no media hashes provided")
+		return
+	}
+	if !s.checkMediaAccess(w, r, true, payload.Hashes...) {
+		return
+	}
+	s.deleteMedias(w, payload.Hashes, payload.Permanent, payload.DeleteFiles)
+}
+
+func (s *Server) serveMediaDelete(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	permanent, err := queryBool(r, "permanent")
+	if err != nil {
+		resp.Errorf(w, http.StatusBadRequest, "%v", err)
+		return
+	}
+	deleteFiles, err := queryBool(r, "delete_files")
+	if err != nil {
+		resp.Errorf(w, http.StatusBadRequest, "%v", err)
+		return
+	}
+	s.deleteMedias(w, []string{vars["hash"]}, permanent, deleteFiles)
+}
+
+func queryBool(r *http.Request, name string) (bool, error) {
+	param := r.URL.Query().Get(name)
+	if param == "" {
+		return false, nil
+	}
+	v, err := strconv.ParseBool(param)
+	if err != nil {
+		return false, fmt.Errorf("invalid %s param: %w", name, err)
+	}
+	return v, nil
+}
+
+type ServeMediasDeleteResult struct {
+	Deleted    []string `json:"deleted"`
+	FileErrors []string `json:"file_errors,omitempty"`
+}
+
+// deleteMedias moves media to the trash, or deletes them permanently, and optionally
+// their files. media in the trash keep deleteFiles for when they're deleted from it.
+// if the files of permanently deleted media are kept, they will be imported again the
+// next time their directories are scanned
+func (s *Server) deleteMedias(w http.ResponseWriter, hashes []string, permanent, deleteFiles bool) {
+	var result ServeMediasDeleteResult
+	if permanent {
+		deleted, err := s.db.DeleteMedias(hashes)
+		if err != nil {
+			resp.Errorf(w, 500, "deleting medias: %v", err)
+			return
+		}
+		result = s.finishDelete(deleted, deleteFiles)
+	} else {
+		trashed, err := s.db.TrashMedias(hashes, deleteFiles)
+		if err != nil {
+			resp.Errorf(w, 500, "trashing medias: %v", err)
+			return
+		}
+		result.Deleted = trashed
+		for _, hash := range trashed {
+			s.publishMediaEvent(&SocketEvent{Type: SocketEventMediaDeleted, Hash: hash, Trashed: true})
+		}
+	}
+	if len(result.Deleted) == 0 {
+		resp.Errorf(w, http.StatusNotFound, "requested media not found")
+		return
+	}
+	resp.Write(w, result)
+}
+
+// finishDelete removes the files of permanently deleted media if deleteFiles or if it
+// was asked for when they were trashed, and notifies clients watching them
+func (s *Server) finishDelete(deleted []*db.DeletedMedia, deleteFiles bool) ServeMediasDeleteResult {
+	var result ServeMediasDeleteResult
+	for _, media := range deleted {
+		result.Deleted = append(result.Deleted, media.Hash)
+		if !deleteFiles && !media.DeleteFiles {
+			continue
+		}
+		for _, file := range media.Files {
+			if err := s.removeFile(file); err != nil {
+				log.Printf("error removing file of deleted media %q: %v", media.Hash, err)
+				result.FileErrors = append(result.FileErrors, err.Error())
+			}
+		}
+	}
+	for _, hash := range result.Deleted {
+		s.publishMediaEvent(&SocketEvent{Type: SocketEventMediaDeleted, Hash: hash})
+	}
+	return result
+}
+
+func (s *Server) serveTrash(w http.ResponseWriter, r *http.Request) {
+	limit, offset := 50, 0
+	params := r.URL.Query()
+	if param := params.Get("limit"); param != "" {
+		var err error
+		if limit, err = strconv.Atoi(param); err != nil {
+			resp.Errorf(w, http.StatusBadRequest, "invalid limit param: %v", err)
+			return
+		}
+	}
+	if param := params.Get("offset"); param != "" {
+		var err error
+		if offset, err = strconv.Atoi(param); err != nil {
+			resp.Errorf(w, http.StatusBadRequest, "invalid offset param: %v", err)
+			return
+		}
+	}
+	library, err := s.requestLibrary(r)
+	if err != nil {
+		resp.Errorf(w, userErrorStatus(err), "getting user: %v", err)
+		return
+	}
+	medias, err := s.db.GetTrashedMedias(library, limit, offset)
+	if err != nil {
+		resp.Errorf(w, 500, "getting trashed medias: %v", err)
+		return
+	}
+	resp.Write(w, medias)
+}
+
+func (s *Server) serveTrashRestore(w http.ResponseWriter, r *http.Request) {
+	var payload struct {
+		Hashes []string `json:"hashes"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		resp.Errorf(w, http.StatusBadRequest, "decode payload: %v", err)
+		return
+	}
+	if !s.checkMediaAccess(w, r, true, payload.Hashes...) {
+		return
+	}
+	restored, err := s.db.RestoreMedias(payload.Hashes)
+	if err != nil {
+		resp.Errorf(w, 500, "restoring medias: %v", err)
+		return
+	}
+	for _, hash := range restored {
+		s.publishMediaEvent(&SocketEvent{Type: SocketEventMediaRestored, Hash: hash})
+	}
+	resp.Write(w, struct {
+		Restored []string `json:"restored"`
+	}{
+		Restored: restored,
+	})
+}
+
+func (s *Server) serveTrashEmpty(w http.ResponseWriter, r *http.Request) {
+	var payload struct {
+		DeleteFiles bool `json:"delete_files"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil && !errors.Is(err, io.EOF) {
+		resp.Errorf(w, http.StatusBadRequest, "decode payload: %v", err)
+		return
+	}
+	deleted, err := s.db.EmptyTrash(time.Now(), payload.DeleteFiles)
+	if err != nil {
+		resp.Errorf(w, 500, "emptying trash: %v", err)
+		return
+	}
+	resp.Write(w, s.finishDelete(deleted, payload.DeleteFiles))
+}
+
+// PurgeTrash periodically deletes media which have been in the trash for longer than
+// retention. their files are only deleted if it was asked for when they were trashed,
+// otherwise their hashes are remembered so that they aren't imported again
+func (s *Server) PurgeTrash(retention time.Duration) {
+	const interval = 1 * time.Hour
+	for ; ; time.Sleep(interval) {
+		deleted, err := s.db.EmptyTrash(time.Now().Add(-retention), false)
+		if err != nil {
+			log.Printf("error purging trash: %v", err)
+			continue
+		}
+		if len(deleted) > 0 {
+			log.Printf("purged %d medias from trash", len(deleted))
+		}
+		s.finishDelete(deleted, false)
+	}
+}
+
+func (s *Server) removeFile(file *db.DirInfo) error {
+	directory, ok := s.directories[file.DirectoryAlias]
+	if !ok {
+		return fmt.Errorf("invalid alias %q", file.DirectoryAlias)
+	}
+	path := filepath.Join(directory, file.Filename)
+	if rel, err := filepath.Rel(directory, path); err != nil || strings.HasPrefix(rel, "..") {
+		return fmt.Errorf("file %q is outside of alias %q", file.Filename, file.DirectoryAlias)
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("remove %q: %w", path, err)
+	}
+	return nil
+}
+
+func (s *Server) serveMediaNote(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	var payload struct {
+		Note string `json:"note"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		resp.Errorf(w, http.StatusBadRequest, "decode payload: %v", err)
+		return
+	}
+	id, err := s.db.SetMediaNote(vars["hash"], strings.TrimSpace(payload.Note))
+	if errors.Is(err, pgx.ErrNoRows) {
+		resp.Errorf(w, http.StatusNotFound, "requested media not found")
+		return
+	}
+	if err != nil {
+		resp.Errorf(w, 500, "setting note: %v", err)
+		return
+	}
+	if err := s.db.UpdateTextSearch(id); err != nil {
+		resp.Errorf(w, 500, "updating text search: %v", err)
+		return
+	}
+	resp.Write(w, struct{}{})
+}
+
+type ServeBlockPayload struct {
+	MinX int    `json:"min_x"`
+	MinY int    `json:"min_y"`
+	MaxX int    `json:"max_x"`
+	MaxY int    `json:"max_y"`
+	Body string `json:"body"`
+}
+
+func (p ServeBlockPayload) block() *db.Block {
+	return &db.Block{
+		MinX: p.MinX,
+		MinY: p.MinY,
+		MaxX: p.MaxX,
+		MaxY: p.MaxY,
+		Body: strings.TrimSpace(p.Body),
+	}
+}
+
+func (s *Server) serveBlockCreate(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	var payload ServeBlockPayload
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		resp.Errorf(w, http.StatusBadRequest, "decode payload: %v", err)
+		return
+	}
+	block, err := s.db.CreateManualBlock(vars["hash"], payload.block())
+	if err != nil {
+		resp.Errorf(w, blockErrorStatus(err), "creating block: %v", err)
+		return
+	}
+	if err := s.db.UpdateTextSearch(block.MediaID); err != nil {
+		resp.Errorf(w, 500, "updating text search: %v", err)
+		return
+	}
+	resp.Write(w, block)
+}
+
+func (s *Server) serveBlockUpdate(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		resp.Errorf(w, http.StatusBadRequest, "invalid block id: %v", err)
+		return
+	}
+	var payload ServeBlockPayload
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		resp.Errorf(w, http.StatusBadRequest, "decode payload: %v", err)
+		return
+	}
+	block := payload.block()
+	block.ID = db.BlockID(id)
+	block, err = s.db.UpdateManualBlock(vars["hash"], block)
+	if err != nil {
+		resp.Errorf(w, blockErrorStatus(err), "updating block: %v", err)
+		return
+	}
+	if err := s.db.UpdateTextSearch(block.MediaID); err != nil {
+		resp.Errorf(w, 500, "updating text search: %v", err)
+		return
+	}
+	resp.Write(w, block)
+}
+
+func (s *Server) serveBlockDelete(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		resp.Errorf(w, http.StatusBadRequest, "invalid block id: %v", err)
+		return
+	}
+	mediaID, err := s.db.DeleteManualBlock(vars["hash"], db.BlockID(id))
+	if err != nil {
+		resp.Errorf(w, blockErrorStatus(err), "deleting block: %v", err)
+		return
+	}
+	if err := s.db.UpdateTextSearch(mediaID); err != nil {
+		resp.Errorf(w, 500, "updating text search: %v", err)
+		return
+	}
+	resp.Write(w, struct{}{})
+}
+
+func blockErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, db.ErrInvalidBlock):
+		return http.StatusBadRequest
+	case errors.Is(err, pgx.ErrNoRows):
+		return http.StatusNotFound
+	}
+	return 500
+}
+
+func (s *Server) serveMediaReprocess(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	if err := s.importer.ReprocessMedia(vars["hash"]); err != nil {
+		resp.Errorf(w, blockErrorStatus(err), "reprocessing media: %v", err)
+		return
+	}
+	resp.Write(w, struct{}{})
+}
+
 type ServeSearchPayload struct {
 	Body      string `json:"body"`
+	Match     string `json:"match"`
 	Directory string `json:"directory"`
 	Media     string `json:"media"`
 	Limit     int    `json:"limit"`
 	Offset    int    `json:"offset"`
+	Cursor    string `json:"cursor"`
 	Sort      struct {
 		Field string `json:"field"`
 		Order string `json:"order"`
 	} `json:"sort"`
-	DateFrom time.Time `json:"date_from"`
-	DateTo   time.Time `json:"date_to"`
+	DateFrom       time.Time `json:"date_from"`
+	DateTo         time.Time `json:"date_to"`
+	Colour         string    `json:"colour"`
+	ColourDistance float64   `json:"colour_distance"`
+	WidthMin       int       `json:"width_min"`
+	WidthMax       int       `json:"width_max"`
+	HeightMin      int       `json:"height_min"`
+	HeightMax      int       `json:"height_max"`
+	AspectMin      float64   `json:"aspect_min"`
+	AspectMax      float64   `json:"aspect_max"`
+	Orientation    string    `json:"orientation"`
+	Tags           []string  `json:"tags"`
+	TagsMatch      string    `json:"tags_match"`
+	Collection     int       `json:"collection"`
+	Starred        bool      `json:"starred"`
+	StarredFirst   bool      `json:"starred_first"`
+	Facets         bool      `json:"facets"`
 }
 
 func (s *Server) serveSearch(w http.ResponseWriter, r *http.Request) {
@@ -307,84 +790,1178 @@ func (s *Server) serveSearch(w http.ResponseWriter, r *http.Request) {
 	defer r.Body.Close()
 
 	start := time.Now()
-	medias, err := s.db.SearchMedias(db.SearchMediasOptions{
-		Body:      payload.Body,
-		Offset:    payload.Offset,
-		Limit:     payload.Limit,
-		SortField: payload.Sort.Field,
-		SortOrder: payload.Sort.Order,
-		Directory: payload.Directory,
-		Media:     db.MediaType(payload.Media),
-		DateFrom:  payload.DateFrom,
-		DateTo:    payload.DateTo,
-	})
+	options := db.SearchMediasOptions{
+		Body:         payload.Body,
+		Match:        db.MatchMode(payload.Match),
+		Offset:       payload.Offset,
+		Limit:        payload.Limit,
+		SortField:    payload.Sort.Field,
+		SortOrder:    payload.Sort.Order,
+		Directory:    payload.Directory,
+		Media:        db.MediaType(payload.Media),
+		DateFrom:     payload.DateFrom,
+		DateTo:       payload.DateTo,
+		WidthMin:     payload.WidthMin,
+		WidthMax:     payload.WidthMax,
+		HeightMin:    payload.HeightMin,
+		HeightMax:    payload.HeightMax,
+		AspectMin:    payload.AspectMin,
+		AspectMax:    payload.AspectMax,
+		Orientation:  db.Orientation(payload.Orientation),
+		Tags:         payload.Tags,
+		TagsMatch:    db.TagsMatch(payload.TagsMatch),
+		Collection:   db.CollectionID(payload.Collection),
+		Starred:      payload.Starred,
+		StarredFirst: payload.StarredFirst,
+	}
+	if userID, ok := requestUserID(r); ok {
+		user, err := s.db.GetUser(userID)
+		if err != nil {
+			resp.Errorf(w, userErrorStatus(err), "getting user: %v", err)
+			return
+		}
+		options.User = user.ID
+		if !user.IsAdmin() {
+			options.Library = user.ID
+		}
+	}
+	if options.Collection != 0 {
+		if _, err := s.db.GetCollection(options.Collection, options.Library); err != nil {
+			resp.Errorf(w, collectionErrorStatus(err), "getting collection: %v", err)
+			return
+		}
+	}
+	if payload.Colour != "" {
+		colour, err := imagery.ParseHex(payload.Colour)
+		if err != nil {
+			resp.Errorf(w, http.StatusBadRequest, "parse colour: %v", err)
+			return
+		}
+		l, a, b := imagery.Lab(colour)
+		options.Colour = &db.Lab{L: l, A: a, B: b}
+		options.ColourDistance = payload.ColourDistance
+	}
+	if payload.Cursor != "" {
+		after, err := db.DecodeSearchCursor(payload.Cursor)
+		if err != nil {
+			resp.Errorf(w, http.StatusBadRequest, "invalid cursor: %v", err)
+			return
+		}
+		options.After = after
+	}
+	medias, err := s.db.SearchMedias(options)
 	if err != nil {
-		resp.Errorf(w, 500, "searching medias: %v", err)
+		resp.Errorf(w, searchErrorStatus(err), "searching medias: %v", err)
 		return
 	}
 
+	// a full page means there may be more to come
+	var nextCursor string
+	if len(medias) > 0 && len(medias) == options.Limit {
+		nextCursor = db.NewSearchCursor(options, medias[len(medias)-1]).Encode()
+	}
+
+	var facets *db.SearchFacets
+	if payload.Facets {
+		facets, err = s.db.SearchMediasFacets(options)
+		if err != nil {
+			resp.Errorf(w, searchErrorStatus(err), "counting search facets: %v", err)
+			return
+		}
+	}
+
 	resp.Write(w, struct {
-		Medias []*db.Media   `json:"medias"`
-		Took   time.Duration `json:"took"`
+		Medias     []*db.Media      `json:"medias"`
+		NextCursor string           `json:"next_cursor,omitempty"`
+		Facets     *db.SearchFacets `json:"facets,omitempty"`
+		Took       time.Duration    `json:"took"`
 	}{
-		Medias: medias,
-		Took:   time.Since(start),
+		Medias:     medias,
+		NextCursor: nextCursor,
+		Facets:     facets,
+		Took:       time.Since(start),
 	})
 }
 
-func (s *Server) serveWebSocket(w http.ResponseWriter, r *http.Request) {
-	params := r.URL.Query()
-	token := params.Get("token")
-
-	conn, err := s.socketUpgrader.Upgrade(w, r, nil)
+func (s *Server) serveTags(w http.ResponseWriter, r *http.Request) {
+	library, err := s.requestLibrary(r)
 	if err != nil {
-		log.Printf("error upgrading socket connection: %v", err)
+		resp.Errorf(w, userErrorStatus(err), "getting user: %v", err)
 		return
 	}
-
-	if w := params.Get("want_settings"); w != "" {
-		if err := auth.TokenParse(s.hmacSecret, token); err != nil {
-			return
-		}
-		s.socketClientsScanner[conn] = struct{}{}
-	}
-	if w := params.Get("want_media_hash"); w != "" {
-		if _, ok := s.socketClientsImporter[w]; !ok {
-			s.socketClientsImporter[w] = map[*websocket.Conn]struct{}{}
-		}
-		s.socketClientsImporter[w][conn] = struct{}{}
+	tags, err := s.db.GetTags(library)
+	if err != nil {
+		resp.Errorf(w, 500, "getting tags: %v", err)
+		return
 	}
+	resp.Write(w, tags)
 }
 
-func (s *Server) serveAuthenticate(w http.ResponseWriter, r *http.Request) {
-	var payload struct {
-		Username string `json:"username"`
-		Password string `json:"password"`
-	}
+type ServeTagsPayload struct {
+	Hashes []string `json:"hashes"`
+	Tags   []string `json:"tags"`
+}
+
+func (s *Server) serveTagsAdd(w http.ResponseWriter, r *http.Request) {
+	var payload ServeTagsPayload
 	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
 		resp.Errorf(w, http.StatusBadRequest, "decode payload: %v", err)
+		return
 	}
-
-	hasUsername := (payload.Username == s.loginUsername)
-	hasPassword := (payload.Password == s.loginPassword)
-	if !hasUsername || !hasPassword {
-		resp.Errorf(w, http.StatusUnauthorized, "unauthorised")
+	if !s.checkMediaAccess(w, r, true, payload.Hashes...) {
 		return
 	}
+	if err := s.db.AddMediaTags(payload.Hashes, payload.Tags); err != nil {
+		resp.Errorf(w, tagErrorStatus(err), "adding tags: %v", err)
+		return
+	}
+	resp.Write(w, struct{}{})
+}
+
+func (s *Server) serveTagsRemove(w http.ResponseWriter, r *http.Request) {
+	var payload ServeTagsPayload
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		resp.Errorf(w, http.StatusBadRequest, "decode payload: %v", err)
+		return
+	}
+	if !s.checkMediaAccess(w, r, true, payload.Hashes...) {
+		return
+	}
+	if err := s.db.RemoveMediaTags(payload.Hashes, payload.Tags); err != nil {
+		resp.Errorf(w, tagErrorStatus(err), "removing tags: %v", err)
+		return
+	}
+	resp.Write(w, struct{}{})
+}
+
+func (s *Server) serveTagRename(w http.ResponseWriter, r *http.Request) {
+	var payload struct {
+		From string `json:"from"`
+		To   string `json:"to"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		resp.Errorf(w, http.StatusBadRequest, "decode payload: %v", err)
+		return
+	}
+	if err := s.db.RenameTag(payload.From, payload.To); err != nil {
+		resp.Errorf(w, tagErrorStatus(err), "renaming tag: %v", err)
+		return
+	}
+	resp.Write(w, struct{}{})
+}
+
+func (s *Server) serveMediaTagAdd(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	if err := s.db.AddMediaTags([]string{vars["hash"]}, []string{vars["tag"]}); err != nil {
+		resp.Errorf(w, tagErrorStatus(err), "adding tag: %v", err)
+		return
+	}
+	resp.Write(w, struct{}{})
+}
+
+func (s *Server) serveMediaTagRemove(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	if err := s.db.RemoveMediaTags([]string{vars["hash"]}, []string{vars["tag"]}); err != nil {
+		resp.Errorf(w, tagErrorStatus(err), "removing tag: %v", err)
+		return
+	}
+	resp.Write(w, struct{}{})
+}
+
+func (s *Server) serveMediaVisibility(w http.ResponseWriter, r *http.Request) {
+	var payload struct {
+		Visibility *db.Visibility `json:"visibility"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		resp.Errorf(w, http.StatusBadRequest, "decode payload: %v", err)
+		return
+	}
+	if err := s.db.SetMediaVisibility(mux.Vars(r)["hash"], payload.Visibility); err != nil {
+		resp.Errorf(w, visibilityErrorStatus(err), "setting media visibility: %v", err)
+		return
+	}
+	resp.Write(w, struct{}{})
+}
+
+func (s *Server) serveDirectoryVisibility(w http.ResponseWriter, r *http.Request) {
+	alias := mux.Vars(r)["alias"]
+	if _, ok := s.directories[alias]; !ok {
+		resp.Errorf(w, http.StatusNotFound, "unknown directory alias %q", alias)
+		return
+	}
+	var payload struct {
+		Visibility db.Visibility `json:"visibility"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		resp.Errorf(w, http.StatusBadRequest, "decode payload: %v", err)
+		return
+	}
+	if err := s.db.SetDirectoryVisibility(alias, payload.Visibility); err != nil {
+		resp.Errorf(w, visibilityErrorStatus(err), "setting directory visibility: %v", err)
+		return
+	}
+	resp.Write(w, struct{}{})
+}
+
+func visibilityErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, db.ErrInvalidVisibility):
+		return http.StatusBadRequest
+	case errors.Is(err, pgx.ErrNoRows):
+		return http.StatusNotFound
+	}
+	return 500
+}
+
+func (s *Server) serveMediaStar(w http.ResponseWriter, r *http.Request) {
+	s.setMediaStarred(w, r, true)
+}
+
+func (s *Server) serveMediaUnstar(w http.ResponseWriter, r *http.Request) {
+	s.setMediaStarred(w, r, false)
+}
+
+func (s *Server) setMediaStarred(w http.ResponseWriter, r *http.Request, starred bool) {
+	// stars belong to users, so api keys without one can't star
+	userID, ok := requestUserID(r)
+	if !ok {
+		resp.Errorf(w, http.StatusForbidden, "starring needs a user")
+		return
+	}
+	err := s.db.SetMediaStarred(mux.Vars(r)["hash"], userID, starred)
+	if errors.Is(err, pgx.ErrNoRows) {
+		resp.Errorf(w, http.StatusNotFound, "requested media not found")
+		return
+	}
+	if err != nil {
+		resp.Errorf(w, 500, "setting media starred: %v", err)
+		return
+	}
+	resp.Write(w, struct{}{})
+}
+
+func tagErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, db.ErrInvalidTag):
+		return http.StatusBadRequest
+	case errors.Is(err, pgx.ErrNoRows):
+		return http.StatusNotFound
+	}
+	return 500
+}
+
+func (s *Server) serveShares(w http.ResponseWriter, r *http.Request) {
+	library, err := s.requestLibrary(r)
+	if err != nil {
+		resp.Errorf(w, userErrorStatus(err), "getting user: %v", err)
+		return
+	}
+	shares, err := s.db.GetShares(r.URL.Query().Get("hash"), library)
+	if err != nil {
+		resp.Errorf(w, 500, "getting shares: %v", err)
+		return
+	}
+	resp.Write(w, shares)
+}
+
+type ServeShareCreatePayload struct {
+	Hash     string     `json:"hash"`
+	Expires  *time.Time `json:"expires"`
+	MaxViews *int       `json:"max_views"`
+	Password string     `json:"password"`
+}
+
+func (s *Server) serveShareCreate(w http.ResponseWriter, r *http.Request) {
+	var payload ServeShareCreatePayload
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		resp.Errorf(w, http.StatusBadRequest, "decode payload: %v", err)
+		return
+	}
+	if payload.MaxViews != nil && *payload.MaxViews < 1 {
+		resp.Errorf(w, http.StatusBadRequest, "max views must be at least 1")
+		return
+	}
+	if payload.Expires != nil && payload.Expires.Before(time.Now()) {
+		resp.Errorf(w, http.StatusBadRequest, "expiry must be in the future")
+		return
+	}
+	if !s.checkMediaAccess(w, r, true, payload.Hash) {
+		return
+	}
+
+	token, err := auth.RandomToken(24)
+	if err != nil {
+		resp.Errorf(w, 500, "making token: %v", err)
+		return
+	}
+	share := &db.Share{
+		Token:    token,
+		Expires:  payload.Expires,
+		MaxViews: payload.MaxViews,
+	}
+	if payload.Password != "" {
+		hash, err := auth.PasswordHash(payload.Password)
+		if err != nil {
+			resp.Errorf(w, 500, "%v", err)
+			return
+		}
+		share.PasswordHash = &hash
+	}
+
+	share, err = s.db.CreateShare(payload.Hash, share)
+	if errors.Is(err, pgx.ErrNoRows) {
+		resp.Errorf(w, http.StatusNotFound, "requested media not found")
+		return
+	}
+	if err != nil {
+		resp.Errorf(w, 500, "creating share: %v", err)
+		return
+	}
+	resp.Write(w, share)
+}
+
+func (s *Server) serveShareDelete(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		resp.Errorf(w, http.StatusBadRequest, "invalid share id: %v", err)
+		return
+	}
+	library, err := s.requestLibrary(r)
+	if err != nil {
+		resp.Errorf(w, userErrorStatus(err), "getting user: %v", err)
+		return
+	}
+	err = s.db.DeleteShare(db.ShareID(id), library)
+	if errors.Is(err, pgx.ErrNoRows) {
+		resp.Errorf(w, http.StatusNotFound, "requested share not found")
+		return
+	}
+	if err != nil {
+		resp.Errorf(w, 500, "deleting share: %v", err)
+		return
+	}
+	resp.Write(w, struct{}{})
+}
+
+// resolveShare finds the share of a request, checking its password. the password is
+// given with the x-share-password header, or the password param for requests which
+// can't send headers
+func (s *Server) resolveShare(w http.ResponseWriter, r *http.Request) (*db.Share, bool) {
+	share, err := s.db.GetShareByToken(mux.Vars(r)["token"])
+	if errors.Is(err, pgx.ErrNoRows) {
+		resp.Errorf(w, http.StatusNotFound, "requested share not found")
+		return nil, false
+	}
+	if err != nil {
+		resp.Errorf(w, 500, "getting share: %v", err)
+		return nil, false
+	}
+	if share.PasswordHash != nil {
+		password := r.Header.Get("x-share-password")
+		if password == "" {
+			password = r.URL.Query().Get("password")
+		}
+		lockoutKey := fmt.Sprintf("%s share %d", s.clientIP(r), share.ID)
+		if wait, locked := s.loginLockout.Locked(lockoutKey); locked {
+			tooManyRequests(w, wait)
+			return nil, false
+		}
+		if !auth.PasswordCheck(*share.PasswordHash, password) {
+			if password != "" {
+				s.loginLockout.Fail(lockoutKey)
+			}
+			resp.Errorf(w, http.StatusForbidden, "share password required")
+			return nil, false
+		}
+		s.loginLockout.Reset(lockoutKey)
+	}
+	return share, true
+}
+
+// serveShareMedia counts a view of the share, after which its raw media and thumbnail
+// can be fetched
+func (s *Server) serveShareMedia(w http.ResponseWriter, r *http.Request) {
+	share, ok := s.resolveShare(w, r)
+	if !ok {
+		return
+	}
+	err := s.db.ViewShare(share.ID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		resp.Errorf(w, http.StatusNotFound, "requested share not found")
+		return
+	}
+	if err != nil {
+		resp.Errorf(w, 500, "viewing share: %v", err)
+		return
+	}
+	media, err := s.db.GetMediaByHashWithRelations(share.MediaHash, 0)
+	if err != nil {
+		resp.Errorf(w, http.StatusBadRequest, "requested media not found: %v", err)
+		return
+	}
+	resp.Write(w, media)
+}
+
+func (s *Server) serveShareRaw(w http.ResponseWriter, r *http.Request) {
+	if share, ok := s.resolveShareViewed(w, r); ok {
+		s.serveRaw(w, r, share.MediaHash)
+	}
+}
+
+func (s *Server) serveShareThumb(w http.ResponseWriter, r *http.Request) {
+	if share, ok := s.resolveShareViewed(w, r); ok {
+		s.serveThumb(w, r, share.MediaHash)
+	}
+}
+
+// shareViewWindow is how long after a view of a share with a view limit that its
+// raw media and thumbnail can be fetched
+const shareViewWindow = 15 * time.Minute
+
+// resolveShareViewed resolves a share which can have its media fetched. shares with
+// a view limit must have been viewed recently, so that the limit can't be dodged by
+// fetching the media directly
+func (s *Server) resolveShareViewed(w http.ResponseWriter, r *http.Request) (*db.Share, bool) {
+	share, ok := s.resolveShare(w, r)
+	if !ok {
+		return nil, false
+	}
+	if share.MaxViews != nil && (share.LastViewed == nil || time.Since(*share.LastViewed) > shareViewWindow) {
+		resp.Errorf(w, http.StatusNotFound, "requested share not found")
+		return nil, false
+	}
+	return share, true
+}
+
+func (s *Server) serveCollections(w http.ResponseWriter, r *http.Request) {
+	library, err := s.requestLibrary(r)
+	if err != nil {
+		resp.Errorf(w, userErrorStatus(err), "getting user: %v", err)
+		return
+	}
+	collections, err := s.db.GetCollections(library)
+	if err != nil {
+		resp.Errorf(w, 500, "getting collections: %v", err)
+		return
+	}
+	resp.Write(w, collections)
+}
+
+func (s *Server) serveCollection(w http.ResponseWriter, r *http.Request) {
+	id, err := collectionID(r)
+	if err != nil {
+		resp.Errorf(w, http.StatusBadRequest, "%v", err)
+		return
+	}
+	library, err := s.requestLibrary(r)
+	if err != nil {
+		resp.Errorf(w, userErrorStatus(err), "getting user: %v", err)
+		return
+	}
+	collection, err := s.db.GetCollection(id, library)
+	if err != nil {
+		resp.Errorf(w, collectionErrorStatus(err), "getting collection: %v", err)
+		return
+	}
+	resp.Write(w, collection)
+}
+
+type ServeCollectionPayload struct {
+	Name      string `json:"name"`
+	CoverHash string `json:"cover_hash"`
+}
+
+func (s *Server) serveCollectionCreate(w http.ResponseWriter, r *http.Request) {
+	var payload ServeCollectionPayload
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		resp.Errorf(w, http.StatusBadRequest, "decode payload: %v", err)
+		return
+	}
+	if payload.CoverHash != "" && !s.checkMediaAccess(w, r, false, payload.CoverHash) {
+		return
+	}
+	var owner *db.UserID
+	if userID, ok := requestUserID(r); ok {
+		owner = &userID
+	}
+	id, err := s.db.CreateCollection(payload.Name, payload.CoverHash, owner)
+	if err != nil {
+		resp.Errorf(w, collectionErrorStatus(err), "creating collection: %v", err)
+		return
+	}
+	resp.Write(w, struct {
+		ID db.CollectionID `json:"id"`
+	}{
+		ID: id,
+	})
+}
+
+func (s *Server) serveCollectionUpdate(w http.ResponseWriter, r *http.Request) {
+	id, err := collectionID(r)
+	if err != nil {
+		resp.Errorf(w, http.StatusBadRequest, "%v", err)
+		return
+	}
+	var payload ServeCollectionPayload
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		resp.Errorf(w, http.StatusBadRequest, "decode payload: %v", err)
+		return
+	}
+	if payload.CoverHash != "" && !s.checkMediaAccess(w, r, false, payload.CoverHash) {
+		return
+	}
+	library, err := s.requestLibrary(r)
+	if err != nil {
+		resp.Errorf(w, userErrorStatus(err), "getting user: %v", err)
+		return
+	}
+	if err := s.db.UpdateCollection(id, library, payload.Name, payload.CoverHash); err != nil {
+		resp.Errorf(w, collectionErrorStatus(err), "updating collection: %v", err)
+		return
+	}
+	resp.Write(w, struct{}{})
+}
+
+func (s *Server) serveCollectionDelete(w http.ResponseWriter, r *http.Request) {
+	id, err := collectionID(r)
+	if err != nil {
+		resp.Errorf(w, http.StatusBadRequest, "%v", err)
+		return
+	}
+	library, err := s.requestLibrary(r)
+	if err != nil {
+		resp.Errorf(w, userErrorStatus(err), "getting user: %v", err)
+		return
+	}
+	if err := s.db.DeleteCollection(id, library); err != nil {
+		resp.Errorf(w, collectionErrorStatus(err), "deleting collection: %v", err)
+		return
+	}
+	resp.Write(w, struct{}{})
+}
+
+type ServeCollectionMediasPayload struct {
+	Hashes []string `json:"hashes"`
+}
+
+func (s *Server) serveCollectionAdd(w http.ResponseWriter, r *http.Request) {
+	s.serveCollectionMedias(w, r, s.db.AddCollectionMedias)
+}
+
+func (s *Server) serveCollectionRemove(w http.ResponseWriter, r *http.Request) {
+	s.serveCollectionMedias(w, r, s.db.RemoveCollectionMedias)
+}
+
+func (s *Server) serveCollectionReorder(w http.ResponseWriter, r *http.Request) {
+	s.serveCollectionMedias(w, r, s.db.ReorderCollectionMedias)
+}
+
+func (s *Server) serveCollectionMedias(w http.ResponseWriter, r *http.Request, f func(db.CollectionID, []string) error) {
+	id, err := collectionID(r)
+	if err != nil {
+		resp.Errorf(w, http.StatusBadRequest, "%v", err)
+		return
+	}
+	var payload ServeCollectionMediasPayload
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		resp.Errorf(w, http.StatusBadRequest, "decode payload: %v", err)
+		return
+	}
+	library, err := s.requestLibrary(r)
+	if err != nil {
+		resp.Errorf(w, userErrorStatus(err), "getting user: %v", err)
+		return
+	}
+	if _, err := s.db.GetCollection(id, library); err != nil {
+		resp.Errorf(w, collectionErrorStatus(err), "getting collection: %v", err)
+		return
+	}
+	if !s.checkMediaAccess(w, r, false, payload.Hashes...) {
+		return
+	}
+	if err := f(id, payload.Hashes); err != nil {
+		resp.Errorf(w, 500, "updating collection medias: %v", err)
+		return
+	}
+	resp.Write(w, struct{}{})
+}
+
+func collectionID(r *http.Request) (db.CollectionID, error) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		return 0, fmt.Errorf("invalid collection id: %w", err)
+	}
+	return db.CollectionID(id), nil
+}
+
+func searchErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, db.ErrCursorWithOffset), errors.Is(err, db.ErrInvalidPattern):
+		return http.StatusBadRequest
+	}
+	return 500
+}
+
+func collectionErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, db.ErrInvalidCollectionName):
+		return http.StatusBadRequest
+	case errors.Is(err, pgx.ErrNoRows):
+		return http.StatusNotFound
+	}
+	return 500
+}
+
+func (s *Server) serveWebSocket(w http.ResponseWriter, r *http.Request) {
+	topics, ok := s.eventTopics(r)
+	if !ok {
+		resp.Errorf(w, http.StatusUnauthorized, "unauthorised")
+		return
+	}
+	conn, err := s.socketUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Printf("error upgrading socket connection: %v", err)
+		return
+	}
+	s.socketHub.Serve(conn, topics...)
+}
+
+func (s *Server) serveEvents(w http.ResponseWriter, r *http.Request) {
+	topics, ok := s.eventTopics(r)
+	if !ok {
+		resp.Errorf(w, http.StatusUnauthorized, "unauthorised")
+		return
+	}
+	s.sseBroker.Serve(w, r, topics...)
+}
+
+func (s *Server) serveAuthenticate(w http.ResponseWriter, r *http.Request) {
+	var payload struct {
+		Username string `json:"username"`
+		Password string `json:"password"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		resp.Errorf(w, http.StatusBadRequest, "decode payload: %v", err)
+	}
+
+	// logins are limited by ip by middleware, and by username here. ips which fail too
+	// often are locked out of the username
+	username := strings.ToLower(payload.Username)
+	if ok, wait := s.limiterLogin.Allow("user " + username); !ok {
+		tooManyRequests(w, wait)
+		return
+	}
+	lockoutKey := fmt.Sprintf("%s user %s", s.clientIP(r), username)
+	if wait, locked := s.loginLockout.Locked(lockoutKey); locked {
+		tooManyRequests(w, wait)
+		return
+	}
+
+	user, err := s.db.GetUserByUsername(payload.Username)
+	if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+		resp.Errorf(w, 500, "getting user: %v", err)
+		return
+	}
+	// check against a dummy hash for unknown users too, so that they take as long
+	// as known ones
+	known := err == nil
+	passwordHash := dummyPasswordHash
+	if known {
+		passwordHash = user.PasswordHash
+	}
+	if !auth.PasswordCheck(passwordHash, payload.Password) || !known {
+		s.loginLockout.Fail(lockoutKey)
+		resp.Errorf(w, http.StatusUnauthorized, "unauthorised")
+		return
+	}
+	s.loginLockout.Reset(lockoutKey)
+
+	s.writeNewSession(w, user)
+}
+
+// newSession starts a session for a user, returning an access token and the session's
+// refresh token
+func (s *Server) newSession(user *db.User) (string, string, error) {
+	refreshToken, err := auth.RandomToken(32)
+	if err != nil {
+		return "", "", fmt.Errorf("generating refresh token: %w", err)
+	}
+	expires := time.Now().Add(auth.RefreshTokenExpiry)
+	if _, err := s.db.CreateSession(user.ID, auth.TokenHash(refreshToken), expires); err != nil {
+		return "", "", fmt.Errorf("creating session: %w", err)
+	}
+	token, err := auth.TokenNew(s.hmacSecret, strconv.Itoa(int(user.ID)), time.Now())
+	if err != nil {
+		return "", "", fmt.Errorf("generating token: %w", err)
+	}
+	return token, refreshToken, nil
+}
+
+func (s *Server) writeNewSession(w http.ResponseWriter, user *db.User) {
+	token, refreshToken, err := s.newSession(user)
+	if err != nil {
+		resp.Errorf(w, 500, "%v", err)
+		return
+	}
+	writeTokens(w, user, token, refreshToken)
+}
+
+func writeTokens(w http.ResponseWriter, user *db.User, token, refreshToken string) {
+	resp.Write(w, struct {
+		Token        string   `json:"token"`
+		RefreshToken string   `json:"refresh_token"`
+		User         *db.User `json:"user"`
+	}{
+		Token:        token,
+		RefreshToken: refreshToken,
+		User:         user,
+	})
+}
+
+func (s *Server) serveAuthenticateMethods(w http.ResponseWriter, r *http.Request) {
+	resp.Write(w, struct {
+		Password bool `json:"password"`
+		Header   bool `json:"header"`
+		OIDC     bool `json:"oidc"`
+	}{
+		Password: true,
+		Header:   s.authHeader != "",
+		OIDC:     s.oidc != nil,
+	})
+}
+
+// externalUser finds the user for someone who has logged in without a socr password,
+// creating them if that's allowed
+func (s *Server) externalUser(username string) (*db.User, error) {
+	if s.createUsers {
+		if err := s.db.CreateExternalUser(username); err != nil {
+			return nil, fmt.Errorf("creating user: %w", err)
+		}
+	}
+	return s.db.GetUserByUsername(username)
+}
+
+// serveAuthenticateHeader logs in the user named by the auth header, for requests from
+// trusted proxies which have already authenticated them
+func (s *Server) serveAuthenticateHeader(w http.ResponseWriter, r *http.Request) {
+	if s.authHeader == "" {
+		resp.Errorf(w, http.StatusNotFound, "header auth not enabled")
+		return
+	}
+	username := r.Header.Get(s.authHeader)
+	if ip := remoteIP(r); ip == nil || !s.isTrustedProxy(ip) || username == "" {
+		resp.Errorf(w, http.StatusUnauthorized, "unauthorised")
+		return
+	}
+	user, err := s.externalUser(username)
+	if errors.Is(err, pgx.ErrNoRows) {
+		resp.Errorf(w, http.StatusForbidden, "unknown user %q", username)
+		return
+	}
+	if err != nil {
+		resp.Errorf(w, userErrorStatus(err), "getting user: %v", err)
+		return
+	}
+	s.writeNewSession(w, user)
+}
+
+func (s *Server) serveOIDCLogin(w http.ResponseWriter, r *http.Request) {
+	if s.oidc == nil {
+		resp.Errorf(w, http.StatusNotFound, "oidc not enabled")
+		return
+	}
+	// only redirect within socr after logging in. browsers treat "/\" like "//" too
+	redirect := r.URL.Query().Get("redirect")
+	if !strings.HasPrefix(redirect, "/") || strings.HasPrefix(redirect, "//") || strings.HasPrefix(redirect, "/\\") {
+		redirect = "/"
+	}
+	authURL, err := s.oidc.StartFlow(r.Context(), redirect)
+	if err != nil {
+		resp.Errorf(w, http.StatusBadGateway, "starting login: %v", err)
+		return
+	}
+	http.Redirect(w, r, authURL, http.StatusFound)
+}
+
+// serveOIDCCallback finishes an oidc login, and sends the user back to the frontend
+// with their tokens in the url fragment, which isn't sent to servers or logged
+func (s *Server) serveOIDCCallback(w http.ResponseWriter, r *http.Request) {
+	if s.oidc == nil {
+		resp.Errorf(w, http.StatusNotFound, "oidc not enabled")
+		return
+	}
+	params := r.URL.Query()
+	if errMsg := params.Get("error"); errMsg != "" {
+		resp.Errorf(w, http.StatusUnauthorized, "logging in: %s %s", errMsg, params.Get("error_description"))
+		return
+	}
+	identity, redirect, err := s.oidc.FinishFlow(r.Context(), params.Get("state"), params.Get("code"))
+	if errors.Is(err, oidc.ErrUnknownFlow) {
+		resp.Errorf(w, http.StatusBadRequest, "finishing login: %v", err)
+		return
+	}
+	if err != nil {
+		resp.Errorf(w, http.StatusUnauthorized, "finishing login: %v", err)
+		return
+	}
+	user, err := s.db.GetIdentityUser(identity.Issuer, identity.Subject, identity.Username, s.createUsers)
+	if errors.Is(err, pgx.ErrNoRows) {
+		resp.Errorf(w, http.StatusForbidden, "unknown user %q", identity.Username)
+		return
+	}
+	if err != nil {
+		resp.Errorf(w, userErrorStatus(err), "getting user: %v", err)
+		return
+	}
+	token, refreshToken, err := s.newSession(user)
+	if err != nil {
+		resp.Errorf(w, 500, "%v", err)
+		return
+	}
+	fragment := url.Values{}
+	fragment.Set("token", token)
+	fragment.Set("refresh_token", refreshToken)
+	fragment.Set("redirect", redirect)
+	http.Redirect(w, r, "/login#"+fragment.Encode(), http.StatusFound)
+}
+
+type ServeRefreshPayload struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+func (s *Server) serveRefresh(w http.ResponseWriter, r *http.Request) {
+	var payload ServeRefreshPayload
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		resp.Errorf(w, http.StatusBadRequest, "decode payload: %v", err)
+		return
+	}
+	defer r.Body.Close()
 
-	token, err := auth.TokenNew(s.hmacSecret)
+	// refresh tokens are swapped for a new one each time they are used
+	refreshToken, err := auth.RandomToken(32)
+	if err != nil {
+		resp.Errorf(w, 500, "generating refresh token: %v", err)
+		return
+	}
+	expires := time.Now().Add(auth.RefreshTokenExpiry)
+	session, err := s.db.RefreshSession(auth.TokenHash(payload.RefreshToken), auth.TokenHash(refreshToken), expires)
+	if errors.Is(err, pgx.ErrNoRows) {
+		resp.Errorf(w, http.StatusUnauthorized, "unauthorised")
+		return
+	}
+	if err != nil {
+		resp.Errorf(w, 500, "refreshing session: %v", err)
+		return
+	}
+	user, err := s.db.GetUser(session.UserID)
+	if err != nil {
+		resp.Errorf(w, 500, "getting user: %v", err)
+		return
+	}
+	token, err := auth.TokenNew(s.hmacSecret, strconv.Itoa(int(user.ID)), time.Now())
 	if err != nil {
 		resp.Errorf(w, 500, "generating token")
 		return
 	}
+	writeTokens(w, user, token, refreshToken)
+}
+
+// serveLogout revokes the request's token, and ends the session of its refresh token
+// if it's given
+func (s *Server) serveLogout(w http.ResponseWriter, r *http.Request) {
+	var payload ServeRefreshPayload
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil && !errors.Is(err, io.EOF) {
+		resp.Errorf(w, http.StatusBadRequest, "decode payload: %v", err)
+		return
+	}
+	defer r.Body.Close()
+
+	userID, _ := requestUserID(r)
+	if payload.RefreshToken != "" {
+		if err := s.db.DeleteSession(userID, auth.TokenHash(payload.RefreshToken)); err != nil {
+			resp.Errorf(w, 500, "deleting session: %v", err)
+			return
+		}
+	}
+	claims, err := auth.TokenParse(s.hmacSecret, requestToken(r))
+	if err != nil {
+		resp.Errorf(w, http.StatusUnauthorized, "unauthorised")
+		return
+	}
+	if err := s.db.RevokeToken(claims.ID, claims.ExpiresAt.Time); err != nil {
+		resp.Errorf(w, 500, "revoking token: %v", err)
+		return
+	}
+	resp.Write(w, struct{}{})
+}
+
+// serveLogoutAll ends every session of the request's user, and revokes all of their
+// tokens
+func (s *Server) serveLogoutAll(w http.ResponseWriter, r *http.Request) {
+	userID, _ := requestUserID(r)
+	if err := s.db.RevokeUserTokens(userID, time.Now()); err != nil {
+		resp.Errorf(w, 500, "revoking tokens: %v", err)
+		return
+	}
+	resp.Write(w, struct{}{})
+}
+
+var dummyPasswordHash, _ = auth.PasswordHash("socr")
+
+// requestUser finds the user of a request which has been through WithJWT
+func (s *Server) requestUser(r *http.Request) (*db.User, error) {
+	userID, _ := requestUserID(r)
+	return s.db.GetUser(userID)
+}
+
+func (s *Server) serveMe(w http.ResponseWriter, r *http.Request) {
+	user, err := s.requestUser(r)
+	if err != nil {
+		resp.Errorf(w, userErrorStatus(err), "getting user: %v", err)
+		return
+	}
+	resp.Write(w, user)
+}
+
+func (s *Server) serveUsers(w http.ResponseWriter, r *http.Request) {
+	users, err := s.db.GetUsers()
+	if err != nil {
+		resp.Errorf(w, 500, "getting users: %v", err)
+		return
+	}
+	resp.Write(w, users)
+}
+
+type ServeUserPayload struct {
+	Username string      `json:"username"`
+	Password string      `json:"password"`
+	Role     db.UserRole `json:"role"`
+}
+
+func (s *Server) serveUserCreate(w http.ResponseWriter, r *http.Request) {
+	var payload ServeUserPayload
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		resp.Errorf(w, http.StatusBadRequest, "decode payload: %v", err)
+		return
+	}
+	defer r.Body.Close()
+
+	// users without a password can only log in through a proxy or oidc
+	if payload.Password == "" && s.authHeader == "" && s.oidc == nil {
+		resp.Errorf(w, http.StatusBadRequest, "no password provided")
+		return
+	}
+	if payload.Role == "" {
+		payload.Role = db.UserRoleMember
+	}
+	var passwordHash string
+	if payload.Password != "" {
+		var err error
+		passwordHash, err = auth.PasswordHash(payload.Password)
+		if err != nil {
+			resp.Errorf(w, 500, "hashing password: %v", err)
+			return
+		}
+	}
+	user, err := s.db.CreateUser(&db.User{
+		Username:     payload.Username,
+		PasswordHash: passwordHash,
+		Role:         payload.Role,
+	})
+	if err != nil {
+		resp.Errorf(w, userErrorStatus(err), "creating user: %v", err)
+		return
+	}
+	resp.Write(w, user)
+}
+
+func (s *Server) serveUserUpdate(w http.ResponseWriter, r *http.Request) {
+	id, err := userID(r)
+	if err != nil {
+		resp.Errorf(w, http.StatusBadRequest, "%v", err)
+		return
+	}
+	var payload ServeUserPayload
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		resp.Errorf(w, http.StatusBadRequest, "decode payload: %v", err)
+		return
+	}
+	defer r.Body.Close()
+
+	// so that there is always an admin left
+	if self, _ := requestUserID(r); id == self && payload.Role != "" && payload.Role != db.UserRoleAdmin {
+		resp.Errorf(w, http.StatusBadRequest, "can't remove admin from yourself")
+		return
+	}
+	var passwordHash string
+	if payload.Password != "" {
+		passwordHash, err = auth.PasswordHash(payload.Password)
+		if err != nil {
+			resp.Errorf(w, 500, "hashing password: %v", err)
+			return
+		}
+	}
+	if err := s.db.UpdateUser(id, payload.Role, passwordHash); err != nil {
+		resp.Errorf(w, userErrorStatus(err), "updating user: %v", err)
+		return
+	}
+	// so that a new password logs out anyone who knew the old one
+	if passwordHash != "" {
+		if err := s.db.RevokeUserTokens(id, time.Now()); err != nil {
+			resp.Errorf(w, 500, "revoking tokens: %v", err)
+			return
+		}
+	}
+	user, err := s.db.GetUser(id)
+	if err != nil {
+		resp.Errorf(w, userErrorStatus(err), "getting user: %v", err)
+		return
+	}
+	resp.Write(w, user)
+}
+
+func (s *Server) serveUserDelete(w http.ResponseWriter, r *http.Request) {
+	id, err := userID(r)
+	if err != nil {
+		resp.Errorf(w, http.StatusBadRequest, "%v", err)
+		return
+	}
+	if self, _ := requestUserID(r); id == self {
+		resp.Errorf(w, http.StatusBadRequest, "can't delete yourself")
+		return
+	}
+	if err := s.db.DeleteUser(id); err != nil {
+		resp.Errorf(w, userErrorStatus(err), "deleting user: %v", err)
+		return
+	}
+	resp.Write(w, struct{}{})
+}
+
+// apiKeysUser is the user whose api keys can be seen and revoked by a request. admins
+// can see everyone's, which is 0
+func (s *Server) apiKeysUser(r *http.Request) (db.UserID, error) {
+	user, err := s.requestUser(r)
+	if err != nil {
+		return 0, err
+	}
+	if user.IsAdmin() {
+		return 0, nil
+	}
+	return user.ID, nil
+}
+
+func (s *Server) serveAPIKeys(w http.ResponseWriter, r *http.Request) {
+	keysUser, err := s.apiKeysUser(r)
+	if err != nil {
+		resp.Errorf(w, userErrorStatus(err), "getting user: %v", err)
+		return
+	}
+	keys, err := s.db.GetAPIKeys(keysUser)
+	if err != nil {
+		resp.Errorf(w, 500, "getting api keys: %v", err)
+		return
+	}
+	resp.Write(w, keys)
+}
+
+type ServeAPIKeyPayload struct {
+	Name  string         `json:"name"`
+	Scope db.APIKeyScope `json:"scope"`
+}
+
+func (s *Server) serveAPIKeyCreate(w http.ResponseWriter, r *http.Request) {
+	var payload ServeAPIKeyPayload
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		resp.Errorf(w, http.StatusBadRequest, "decode payload: %v", err)
+		return
+	}
+	defer r.Body.Close()
+
+	user, err := s.requestUser(r)
+	if err != nil {
+		resp.Errorf(w, userErrorStatus(err), "getting user: %v", err)
+		return
+	}
+	if payload.Scope == db.APIKeyScopeAdmin && !user.IsAdmin() {
+		resp.Errorf(w, http.StatusForbidden, "only admins can create admin api keys")
+		return
+	}
 
+	// the key is only shown now, after that only its hash is kept
+	key, err := auth.RandomToken(32)
+	if err != nil {
+		resp.Errorf(w, 500, "generating key: %v", err)
+		return
+	}
+	apiKey, err := s.db.CreateAPIKey(&db.APIKey{
+		Name:    payload.Name,
+		KeyHash: auth.TokenHash(key),
+		Scope:   payload.Scope,
+		UserID:  &user.ID,
+	})
+	if err != nil {
+		resp.Errorf(w, apiKeyErrorStatus(err), "creating api key: %v", err)
+		return
+	}
 	resp.Write(w, struct {
-		Token string `json:"token"`
+		*db.APIKey
+		Key string `json:"key"`
 	}{
-		Token: token,
+		APIKey: apiKey,
+		Key:    key,
 	})
 }
 
+func (s *Server) serveAPIKeyDelete(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		resp.Errorf(w, http.StatusBadRequest, "invalid api key id: %v", err)
+		return
+	}
+	keysUser, err := s.apiKeysUser(r)
+	if err != nil {
+		resp.Errorf(w, userErrorStatus(err), "getting user: %v", err)
+		return
+	}
+	if err := s.db.DeleteAPIKey(db.APIKeyID(id), keysUser); err != nil {
+		resp.Errorf(w, apiKeyErrorStatus(err), "deleting api key: %v", err)
+		return
+	}
+	resp.Write(w, struct{}{})
+}
+
+func apiKeyErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, db.ErrInvalidAPIKey):
+		return http.StatusBadRequest
+	case errors.Is(err, pgx.ErrNoRows):
+		return http.StatusNotFound
+	}
+	return 500
+}
+
+func userID(r *http.Request) (db.UserID, error) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		return 0, fmt.Errorf("invalid user id: %w", err)
+	}
+	return db.UserID(id), nil
+}
+
+func userErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, db.ErrInvalidUser):
+		return http.StatusBadRequest
+	case errors.Is(err, db.ErrUserExists):
+		return http.StatusConflict
+	case errors.Is(err, db.ErrIdentityConflict):
+		return http.StatusForbidden
+	case errors.Is(err, pgx.ErrNoRows):
+		return http.StatusNotFound
+	}
+	return 500
+}
+
 func (s *Server) serveImportStatus(w http.ResponseWriter, r *http.Request) {
 	type respStatusError struct {
 		Time  time.Time `json:"time"`
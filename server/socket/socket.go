@@ -0,0 +1,182 @@
+package socket
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// writeWait is how long a client has to accept a message
+	writeWait = 10 * time.Second
+	// pongWait is how long a client has to answer a ping, which is sent every
+	// pingPeriod
+	pongWait   = 60 * time.Second
+	pingPeriod = pongWait * 9 / 10
+	// sendQueue is how many messages a client can fall behind by before it's dropped
+	sendQueue = 16
+	// readLimit is the largest message a client may send. clients aren't expected to
+	// send anything but control messages
+	readLimit = 512
+)
+
+// Topic is something clients can listen for, such as scanner updates or the
+// processing of a media
+type Topic string
+
+// Hub sends messages to the clients listening for their topics. it's safe for
+// concurrent use
+type Hub struct {
+	mu     sync.Mutex
+	topics map[Topic]map[*client]struct{}
+}
+
+type client struct {
+	conn   *websocket.Conn
+	topics []Topic
+	send   chan []byte
+}
+
+func NewHub() *Hub {
+	return &Hub{
+		topics: map[Topic]map[*client]struct{}{},
+	}
+}
+
+// Serve registers conn as a client listening for topics, and keeps it alive until it
+// closes or can't keep up. it blocks until then, and closes conn
+func (h *Hub) Serve(conn *websocket.Conn, topics ...Topic) {
+	c := &client{
+		conn:   conn,
+		topics: topics,
+		send:   make(chan []byte, sendQueue),
+	}
+	h.register(c)
+	go h.writePump(c)
+	h.readPump(c)
+}
+
+// Publish sends msg once to every client listening for any of topics. clients which
+// have fallen too far behind are dropped rather than blocking
+func (h *Hub) Publish(msg []byte, topics ...Topic) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	sent := map[*client]struct{}{}
+	for _, topic := range topics {
+		for c := range h.topics[topic] {
+			if _, ok := sent[c]; ok {
+				continue
+			}
+			sent[c] = struct{}{}
+			select {
+			case c.send <- msg:
+			default:
+				log.Printf("dropping slow socket client")
+				h.unregisterLocked(c)
+			}
+		}
+	}
+}
+
+// Count is the number of clients listening for topic
+func (h *Hub) Count(topic Topic) int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return len(h.topics[topic])
+}
+
+func (h *Hub) register(c *client) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for _, topic := range c.topics {
+		if _, ok := h.topics[topic]; !ok {
+			h.topics[topic] = map[*client]struct{}{}
+		}
+		h.topics[topic][c] = struct{}{}
+	}
+}
+
+func (h *Hub) unregister(c *client) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.unregisterLocked(c)
+}
+
+// unregisterLocked removes a client from its topics, and topics without clients from
+// the hub. closing its queue stops its write pump, which closes its conn
+func (h *Hub) unregisterLocked(c *client) {
+	registered := false
+	for _, topic := range c.topics {
+		clients, ok := h.topics[topic]
+		if !ok {
+			continue
+		}
+		if _, ok := clients[c]; ok {
+			registered = true
+			delete(clients, c)
+		}
+		if len(clients) == 0 {
+			delete(h.topics, topic)
+		}
+	}
+	if registered {
+		close(c.send)
+	}
+}
+
+// readPump reads from a client until it closes, so that control messages such as
+// pongs and closes are handled
+func (h *Hub) readPump(c *client) {
+	defer func() {
+		h.unregister(c)
+		c.conn.Close()
+	}()
+
+	c.conn.SetReadLimit(readLimit)
+	_ = c.conn.SetReadDeadline(time.Now().Add(pongWait))
+	c.conn.SetPongHandler(func(string) error {
+		return c.conn.SetReadDeadline(time.Now().Add(pongWait))
+	})
+	for {
+		if _, _, err := c.conn.ReadMessage(); err != nil {
+			return
+		}
+	}
+}
+
+// writePump writes a client's queue to it, and pings it so that dead connections are
+// noticed. it's the only writer of a client's conn
+func (h *Hub) writePump(c *client) {
+	ticker := time.NewTicker(pingPeriod)
+	defer func() {
+		ticker.Stop()
+		c.conn.Close()
+	}()
+
+	for {
+		select {
+		case msg, ok := <-c.send:
+			_ = c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if !ok {
+				_ = c.conn.WriteMessage(websocket.CloseMessage, nil)
+				return
+			}
+			if err := c.conn.WriteMessage(websocket.TextMessage, msg); err != nil {
+				h.unregister(c)
+				return
+			}
+		case <-ticker.C:
+			_ = c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				h.unregister(c)
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,145 @@
+package socket_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"go.senan.xyz/socr/server/socket"
+)
+
+// newServer serves a hub, with clients listening for the topics in their "topic"
+// params
+func newServer(t *testing.T, hub *socket.Hub) string {
+	t.Helper()
+	upgrader := websocket.Upgrader{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		var topics []socket.Topic
+		for _, topic := range r.URL.Query()["topic"] {
+			topics = append(topics, socket.Topic(topic))
+		}
+		hub.Serve(conn, topics...)
+	}))
+	t.Cleanup(server.Close)
+	return "ws" + strings.TrimPrefix(server.URL, "http")
+}
+
+func dial(t *testing.T, url string, topics ...string) *websocket.Conn {
+	t.Helper()
+	if len(topics) > 0 {
+		url += "?topic=" + strings.Join(topics, "&topic=")
+	}
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatalf("dialing: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// waitCount waits for the hub to have count clients for topic, since clients register
+// and unregister in the background
+func waitCount(t *testing.T, hub *socket.Hub, topic socket.Topic, count int) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for hub.Count(topic) != count {
+		if time.Now().After(deadline) {
+			t.Fatalf("topic %q has %d clients expected %d", topic, hub.Count(topic), count)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestPublish(t *testing.T) {
+	hub := socket.NewHub()
+	url := newServer(t, hub)
+
+	a := dial(t, url, "a")
+	ab := dial(t, url, "a", "b")
+	waitCount(t, hub, "a", 2)
+	waitCount(t, hub, "b", 1)
+
+	hub.Publish([]byte("to b"), "b")
+	hub.Publish([]byte("to a"), "a")
+	hub.Publish([]byte("to a and b"), "a", "b")
+	// clients listening for both get the last message once, so they read this next
+	hub.Publish([]byte("to a again"), "a")
+
+	tcases := []struct {
+		conn     *websocket.Conn
+		expected []string
+	}{
+		{conn: a, expected: []string{"to a", "to a and b", "to a again"}},
+		{conn: ab, expected: []string{"to b", "to a", "to a and b", "to a again"}},
+	}
+	for i, tcase := range tcases {
+		for _, expected := range tcase.expected {
+			_ = tcase.conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+			_, msg, err := tcase.conn.ReadMessage()
+			if err != nil {
+				t.Fatalf("client %d reading: %v", i, err)
+			}
+			if string(msg) != expected {
+				t.Errorf("client %d read %q expected %q", i, msg, expected)
+			}
+		}
+	}
+}
+
+func TestUnregister(t *testing.T) {
+	hub := socket.NewHub()
+	url := newServer(t, hub)
+
+	conn := dial(t, url, "a", "b")
+	waitCount(t, hub, "a", 1)
+
+	conn.Close()
+	waitCount(t, hub, "a", 0)
+	waitCount(t, hub, "b", 0)
+
+	// publishing to topics without clients is fine
+	hub.Publish([]byte("to no one"), "a")
+}
+
+func TestConcurrent(t *testing.T) {
+	hub := socket.NewHub()
+	url := newServer(t, hub)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			conn, _, err := websocket.DefaultDialer.Dial(url+"?topic=a", nil)
+			if err != nil {
+				t.Errorf("dialing: %v", err)
+				return
+			}
+			defer conn.Close()
+			_ = conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+			for {
+				if _, _, err := conn.ReadMessage(); err != nil {
+					return
+				}
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				hub.Publish([]byte("msg"), "a")
+				hub.Count("a")
+			}
+		}()
+	}
+	wg.Wait()
+	waitCount(t, hub, "a", 0)
+}
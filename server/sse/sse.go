@@ -0,0 +1,216 @@
+package sse
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"go.senan.xyz/socr/server/socket"
+)
+
+const (
+	// keepAlive is how often idle clients are sent a comment, so that proxies don't
+	// close their streams
+	keepAlive = 30 * time.Second
+	// sendQueue is how many events a client can fall behind by before it's dropped.
+	// dropped clients reconnect, and catch up from the history
+	sendQueue = 16
+	// retry is how long clients wait before reconnecting
+	retry = 3 * time.Second
+)
+
+// Broker streams messages as server-sent events to the clients listening for their
+// topics. it remembers the last few messages, so that clients which reconnect with a
+// Last-Event-ID can resume where they left off. it's safe for concurrent use
+type Broker struct {
+	mu      sync.Mutex
+	clients map[*client]struct{}
+	history []event // ring of the most recent events, oldest at next
+	next    int
+	lastID  uint64
+}
+
+type event struct {
+	id     uint64
+	topics []socket.Topic
+	msg    []byte
+}
+
+type client struct {
+	topics []socket.Topic
+	send   chan event
+}
+
+// NewBroker makes a broker which remembers the last historySize messages
+func NewBroker(historySize int) *Broker {
+	return &Broker{
+		clients: map[*client]struct{}{},
+		history: make([]event, 0, historySize),
+	}
+}
+
+// Publish sends msg to every client listening for any of topics, as one event. clients
+// which have fallen too far behind are dropped rather than blocking
+func (b *Broker) Publish(msg []byte, topics ...socket.Topic) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.lastID++
+	ev := event{id: b.lastID, topics: topics, msg: msg}
+	if len(b.history) < cap(b.history) {
+		b.history = append(b.history, ev)
+	} else if len(b.history) > 0 {
+		b.history[b.next] = ev
+		b.next = (b.next + 1) % len(b.history)
+	}
+
+	for c := range b.clients {
+		if !c.wants(ev) {
+			continue
+		}
+		select {
+		case c.send <- ev:
+		default:
+			log.Printf("dropping slow sse client")
+			b.unregisterLocked(c)
+		}
+	}
+}
+
+// Count is the number of clients listening for topic
+func (b *Broker) Count(topic socket.Topic) int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var count int
+	for c := range b.clients {
+		for _, t := range c.topics {
+			if t == topic {
+				count++
+				break
+			}
+		}
+	}
+	return count
+}
+
+// Serve streams the events for topics to the client of r, starting with the ones it
+// missed since its Last-Event-ID. it blocks until the client goes away or can't keep up
+func (b *Broker) Serve(w http.ResponseWriter, r *http.Request, topics ...socket.Topic) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	var lastID uint64
+	if header := r.Header.Get("last-event-id"); header != "" {
+		lastID, _ = strconv.ParseUint(header, 10, 64)
+	}
+
+	c := &client{
+		topics: topics,
+		send:   make(chan event, sendQueue),
+	}
+	missed := b.register(c, lastID)
+	defer b.unregister(c)
+
+	w.Header().Set("content-type", "text/event-stream")
+	w.Header().Set("cache-control", "no-cache")
+	w.Header().Set("x-accel-buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	if _, err := fmt.Fprintf(w, "retry: %d\n\n", retry.Milliseconds()); err != nil {
+		return
+	}
+	for _, ev := range missed {
+		if err := writeEvent(w, ev); err != nil {
+			return
+		}
+	}
+	flusher.Flush()
+
+	ticker := time.NewTicker(keepAlive)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case ev, ok := <-c.send:
+			if !ok {
+				return
+			}
+			if err := writeEvent(w, ev); err != nil {
+				return
+			}
+		case <-ticker.C:
+			if _, err := fmt.Fprint(w, ": keep alive\n\n"); err != nil {
+				return
+			}
+		case <-r.Context().Done():
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+// register adds a client, returning the events it wants from the history which came
+// after lastID. ids from before a restart are newer than any we know of, so all of
+// the history is returned for them
+func (b *Broker) register(c *client, lastID uint64) []event {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.clients[c] = struct{}{}
+	if lastID == 0 {
+		return nil
+	}
+	if lastID > b.lastID {
+		lastID = 0
+	}
+
+	var missed []event
+	for i := range b.history {
+		ev := b.history[(b.next+i)%len(b.history)]
+		if ev.id > lastID && c.wants(ev) {
+			missed = append(missed, ev)
+		}
+	}
+	return missed
+}
+
+func (b *Broker) unregister(c *client) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.unregisterLocked(c)
+}
+
+// unregisterLocked removes a client. closing its queue ends its stream
+func (b *Broker) unregisterLocked(c *client) {
+	if _, ok := b.clients[c]; !ok {
+		return
+	}
+	delete(b.clients, c)
+	close(c.send)
+}
+
+func (c *client) wants(ev event) bool {
+	for _, want := range c.topics {
+		for _, topic := range ev.topics {
+			if want == topic {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// writeEvent writes an event's message as its data. messages are json, so they never
+// span lines
+func writeEvent(w http.ResponseWriter, ev event) error {
+	_, err := fmt.Fprintf(w, "id: %d\ndata: %s\n\n", ev.id, ev.msg)
+	return err
+}
@@ -0,0 +1,147 @@
+package sse_test
+
+import (
+	"bufio"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"go.senan.xyz/socr/server/socket"
+	"go.senan.xyz/socr/server/sse"
+)
+
+// newServer serves a broker, with clients listening for the topics in their "topic"
+// params
+func newServer(t *testing.T, broker *sse.Broker) string {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var topics []socket.Topic
+		for _, topic := range r.URL.Query()["topic"] {
+			topics = append(topics, socket.Topic(topic))
+		}
+		broker.Serve(w, r, topics...)
+	}))
+	t.Cleanup(server.Close)
+	return server.URL
+}
+
+type stream struct {
+	*bufio.Scanner
+}
+
+func connect(t *testing.T, url, lastID string, topics ...string) *stream {
+	t.Helper()
+	if len(topics) > 0 {
+		url += "?topic=" + strings.Join(topics, "&topic=")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if lastID != "" {
+		req.Header.Set("last-event-id", lastID)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("connecting: %v", err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	if ct := resp.Header.Get("content-type"); ct != "text/event-stream" {
+		t.Fatalf("content type %q", ct)
+	}
+	return &stream{bufio.NewScanner(resp.Body)}
+}
+
+// next reads the next event's id and data, skipping other fields
+func (s *stream) next(t *testing.T) (string, string) {
+	t.Helper()
+	var id, data string
+	for s.Scan() {
+		line := s.Text()
+		switch {
+		case line == "" && data != "":
+			return id, data
+		case strings.HasPrefix(line, "id: "):
+			id = strings.TrimPrefix(line, "id: ")
+		case strings.HasPrefix(line, "data: "):
+			data = strings.TrimPrefix(line, "data: ")
+		}
+	}
+	t.Fatalf("reading stream: %v", s.Err())
+	return "", ""
+}
+
+func waitCount(t *testing.T, broker *sse.Broker, topic socket.Topic, count int) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for broker.Count(topic) != count {
+		if time.Now().After(deadline) {
+			t.Fatalf("topic %q has %d clients expected %d", topic, broker.Count(topic), count)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestPublish(t *testing.T) {
+	broker := sse.NewBroker(8)
+	url := newServer(t, broker)
+
+	a := connect(t, url, "", "a")
+	ab := connect(t, url, "", "a", "b")
+	waitCount(t, broker, "a", 2)
+
+	broker.Publish([]byte("to b"), "b")
+	broker.Publish([]byte("to a and b"), "a", "b")
+
+	tcases := []struct {
+		stream   *stream
+		expected []string
+	}{
+		{stream: a, expected: []string{"2 to a and b"}},
+		{stream: ab, expected: []string{"1 to b", "2 to a and b"}},
+	}
+	for i, tcase := range tcases {
+		for _, expected := range tcase.expected {
+			id, data := tcase.stream.next(t)
+			if actual := id + " " + data; actual != expected {
+				t.Errorf("client %d read %q expected %q", i, actual, expected)
+			}
+		}
+	}
+}
+
+func TestResume(t *testing.T) {
+	broker := sse.NewBroker(3)
+	url := newServer(t, broker)
+
+	for _, msg := range []string{"1", "2", "3", "4", "5"} {
+		broker.Publish([]byte(msg), "a")
+	}
+	broker.Publish([]byte("not for a"), "b")
+
+	tcases := []struct {
+		lastID   string
+		expected string
+	}{
+		{lastID: "4", expected: "5"},
+		{lastID: "1", expected: "4"}, // 2 and 3 have left the history
+		{lastID: "100", expected: "4"},
+	}
+	for _, tcase := range tcases {
+		s := connect(t, url, tcase.lastID, "a")
+		if _, data := s.next(t); data != tcase.expected {
+			t.Errorf("resuming from %s read %q expected %q", tcase.lastID, data, tcase.expected)
+		}
+	}
+
+	// without a last id, only new events are sent. the resumed clients are still
+	// listening too
+	s := connect(t, url, "", "a")
+	waitCount(t, broker, "a", len(tcases)+1)
+	broker.Publish([]byte("new"), "a")
+	if _, data := s.next(t); data != "new" {
+		t.Errorf("read %q expected %q", data, "new")
+	}
+}
@@ -4,18 +4,62 @@ export const urlMedia = '/api/media'
 export const urlSearch = '/api/search'
 export const urlStartImport = '/api/start_import'
 export const urlAuthenticate = '/api/authenticate'
+export const urlRefresh = '/api/refresh'
+export const urlOIDCLogin = '/api/oidc/login'
+export const urlLogout = '/api/logout'
+export const urlLogoutAll = '/api/logout_all'
 export const urlSocket = '/api/websocket'
+export const urlEvents = '/api/events'
 export const urlAbout = '/api/about'
 export const urlDirectories = '/api/directories'
 export const urlImportStatus = '/api/import_status'
 export const urlPing = '/api/ping'
 export const urlUpload = '/api/upload'
+export const urlTags = '/api/tags'
+export const urlCollections = '/api/collections'
+export const urlTrash = '/api/trash'
+export const urlShare = '/api/share'
+export const urlShares = '/api/shares'
+export const urlMe = '/api/me'
+export const urlUsers = '/api/users'
+export const urlAPIKeys = '/api/api_keys'
 
 const tokenKey = 'token'
 export const tokenSet = (token: string) => localStorage.setItem(tokenKey, token)
 export const tokenGet = () => localStorage.getItem(tokenKey) || undefined
 export const tokenHas = () => !!localStorage.getItem(tokenKey)
 
+const refreshTokenKey = 'refresh_token'
+export const refreshTokenSet = (token: string) => localStorage.setItem(refreshTokenKey, token)
+export const refreshTokenGet = () => localStorage.getItem(refreshTokenKey) || undefined
+
+// tokens are short lived, so they are refreshed when they expire. refresh tokens can
+// only be used once, so requests which fail at the same time share one refresh
+let refreshing: Promise<boolean> | undefined
+const tokenRefresh = () => {
+  if (refreshing) return refreshing
+  refreshing = (async () => {
+    const refresh_token = refreshTokenGet()
+    if (!refresh_token) return false
+    const response = await fetch(urlRefresh, { method: 'post', body: JSON.stringify({ refresh_token }) })
+    if (!response.ok) return false
+    const resp: Success<Authenticate> = await response.json()
+    tokenSet(resp.result.token)
+    refreshTokenSet(resp.result.refresh_token)
+    return true
+  })()
+  refreshing.finally(() => (refreshing = undefined))
+  return refreshing
+}
+
+// withToken authenticates urls that can't send headers, such as those of images, so
+// that private media can be seen
+export const withToken = (url: string) => {
+  const token = tokenGet()
+  if (!token) return url
+  return `${url}?${new URLSearchParams({ token })}`
+}
+
 export type Error = {
   error: string
 }
@@ -28,18 +72,23 @@ export type Reponse<T> = Promise<Success<T> | Error>
 
 export const isError = <T>(r: Success<T> | Error): r is Error => (r as Error).error !== undefined
 
-type ReqMethod = 'get' | 'post' | 'put'
-const req = async <P, R>(method: ReqMethod, url: string, data?: P): Reponse<R> => {
-  const token = tokenGet()
-
-  let headers: HeadersInit = {}
-  if (token) headers.authorization = `bearer ${token}`
-
+type ReqMethod = 'get' | 'post' | 'put' | 'delete'
+const req = async <P, R>(method: ReqMethod, url: string, data?: P, extraHeaders: Record<string, string> = {}): Reponse<R> => {
   let body: BodyInit = ''
   if (data instanceof FormData) body = data
   else body = JSON.stringify(data)
 
-  const response = await fetch(url, { method, body, headers })
+  const send = () => {
+    const token = tokenGet()
+    let headers: HeadersInit = { ...extraHeaders }
+    if (token) headers.authorization = `bearer ${token}`
+    return fetch(url, { method, body, headers })
+  }
+
+  let response = await send()
+  if (response?.status === 401 && !url.startsWith(urlAuthenticate) && (await tokenRefresh())) {
+    response = await send()
+  }
   if (response?.status === 401) {
     router.push({ name: routes.LOGIN })
   }
@@ -61,15 +110,51 @@ export type PayloadSort = {
   order: SortOrder
 }
 
+export enum MatchMode {
+  Fuzzy = 'fuzzy',
+  Exact = 'exact',
+  Insensitive = 'insensitive',
+  Regex = 'regex',
+  FullText = 'fulltext',
+}
+
 export type PayloadSearch = {
   body: string
+  match?: MatchMode
   limit: number
-  offset: number
+  offset?: number
+  cursor?: string
   sort: PayloadSort
   directory?: string
   media?: MediaType
   date_from?: Date
   date_to?: Date
+  colour?: string
+  colour_distance?: number
+  width_min?: number
+  width_max?: number
+  height_min?: number
+  height_max?: number
+  aspect_min?: number
+  aspect_max?: number
+  orientation?: Orientation
+  tags?: string[]
+  tags_match?: TagsMatch
+  collection?: CollectionID
+  starred?: boolean
+  starred_first?: boolean
+  facets?: boolean
+}
+
+export enum TagsMatch {
+  Any = 'any',
+  All = 'all',
+}
+
+export enum Orientation {
+  Portrait = 'portrait',
+  Landscape = 'landscape',
+  Square = 'square',
 }
 
 export const reqSearch = (data: PayloadSearch) => {
@@ -93,6 +178,65 @@ export const reqMedia = (id: string) => {
   return req<{}, Media>('get', `${urlMedia}/${id}`)
 }
 
+export type PayloadMediasDelete = {
+  hashes: string[]
+  permanent?: boolean
+  delete_files?: boolean
+}
+
+export type MediasDelete = {
+  deleted: string[]
+  file_errors?: string[]
+}
+
+export const reqMediasDelete = (data: PayloadMediasDelete) => {
+  return req<PayloadMediasDelete, MediasDelete>('post', `${urlMedia}/delete`, data)
+}
+
+export const reqMediaDelete = (id: string, permanent = false, deleteFiles = false) => {
+  return req<{}, MediasDelete>('delete', `${urlMedia}/${id}?permanent=${permanent}&delete_files=${deleteFiles}`)
+}
+
+export const reqTrash = (limit: number, offset: number) => {
+  return req<{}, Media[]>('get', `${urlTrash}?limit=${limit}&offset=${offset}`)
+}
+
+export const reqTrashRestore = (hashes: string[]) => {
+  return req<{ hashes: string[] }, { restored: string[] }>('post', `${urlTrash}/restore`, { hashes })
+}
+
+export const reqTrashEmpty = (deleteFiles = false) => {
+  return req<{ delete_files: boolean }, MediasDelete>('post', `${urlTrash}/empty`, { delete_files: deleteFiles })
+}
+
+export const reqMediaVisibility = (id: string, visibility: Visibility | null) => {
+  return req<{ visibility: Visibility | null }, {}>('put', `${urlMedia}/${id}/visibility`, { visibility })
+}
+
+export const reqMediaStar = (id: string, starred: boolean) => {
+  return req<{}, {}>(starred ? 'put' : 'delete', `${urlMedia}/${id}/star`)
+}
+
+export const reqMediaNote = (id: string, note: string) => {
+  return req<{ note: string }, {}>('put', `${urlMedia}/${id}/note`, { note })
+}
+
+export const reqBlockCreate = (id: string, data: PayloadBlock) => {
+  return req<PayloadBlock, Block>('post', `${urlMedia}/${id}/blocks`, data)
+}
+
+export const reqBlockUpdate = (id: string, blockID: BlockID, data: PayloadBlock) => {
+  return req<PayloadBlock, Block>('put', `${urlMedia}/${id}/blocks/${blockID}`, data)
+}
+
+export const reqBlockDelete = (id: string, blockID: BlockID) => {
+  return req<{}, {}>('delete', `${urlMedia}/${id}/blocks/${blockID}`)
+}
+
+export const reqMediaReprocess = (id: string) => {
+  return req<{}, {}>('post', `${urlMedia}/${id}/reprocess`)
+}
+
 export const reqAbout = () => {
   return req<{}, About>('get', urlAbout)
 }
@@ -101,6 +245,10 @@ export const reqDirectories = () => {
   return req<{}, Directory[]>('get', urlDirectories)
 }
 
+export const reqDirectoryVisibility = (alias: string, visibility: Visibility) => {
+  return req<{ visibility: Visibility }, {}>('put', `${urlDirectories}/${alias}/visibility`, { visibility })
+}
+
 export const reqImportStatus = () => {
   return req<{}, ImportStatus>('get', urlImportStatus)
 }
@@ -113,6 +261,198 @@ export const reqUpload = (data: FormData) => {
   return req<FormData, Upload>('post', urlUpload, data)
 }
 
+export const reqTags = () => {
+  return req<{}, TagCount[]>('get', urlTags)
+}
+
+export type PayloadTags = {
+  hashes: string[]
+  tags: string[]
+}
+
+export const reqTagsAdd = (data: PayloadTags) => {
+  return req<PayloadTags, {}>('post', `${urlTags}/add`, data)
+}
+
+export const reqTagsRemove = (data: PayloadTags) => {
+  return req<PayloadTags, {}>('post', `${urlTags}/remove`, data)
+}
+
+export type PayloadTagRename = {
+  from: string
+  to: string
+}
+
+export const reqTagRename = (data: PayloadTagRename) => {
+  return req<PayloadTagRename, {}>('post', `${urlTags}/rename`, data)
+}
+
+export type ShareID = ID<'Share ID'>
+export type Share = {
+  id: ShareID
+  token: string
+  media_id: MediaID
+  media_hash: string
+  created: string
+  expires?: string
+  max_views?: number
+  views: number
+  last_viewed?: string
+  has_password: boolean
+}
+
+export type PayloadShareCreate = {
+  hash: string
+  expires?: Date
+  max_views?: number
+  password?: string
+}
+
+export const reqShares = (hash?: string) => {
+  return req<{}, Share[]>('get', hash ? `${urlShares}?${new URLSearchParams({ hash })}` : urlShares)
+}
+
+export const reqShareCreate = (data: PayloadShareCreate) => {
+  return req<PayloadShareCreate, Share>('post', urlShares, data)
+}
+
+export const reqShareDelete = (id: ShareID) => {
+  return req<{}, {}>('delete', `${urlShares}/${id}`)
+}
+
+export const reqShareMedia = (token: string, password?: string) => {
+  const headers: Record<string, string> = password ? { 'x-share-password': password } : {}
+  return req<{}, Media>('get', `${urlShare}/${token}`, undefined, headers)
+}
+
+export const shareMediaURL = (token: string, kind: 'raw' | 'thumb', password?: string) => {
+  const url = `${urlShare}/${token}/${kind}`
+  if (!password) return url
+  return `${url}?${new URLSearchParams({ password })}`
+}
+
+export type AuthenticateMethods = {
+  password: boolean
+  header: boolean
+  oidc: boolean
+}
+
+export const reqAuthenticateMethods = () => {
+  return req<{}, AuthenticateMethods>('get', `${urlAuthenticate}/methods`)
+}
+
+export const reqAuthenticateHeader = () => {
+  return req<{}, Authenticate>('post', `${urlAuthenticate}/header`)
+}
+
+export const oidcLoginURL = (redirect: string) => {
+  return `${urlOIDCLogin}?${new URLSearchParams({ redirect })}`
+}
+
+export const reqLogout = (all = false) => {
+  const refresh_token = refreshTokenGet()
+  if (all) return req<{}, {}>('post', urlLogoutAll)
+  return req<{ refresh_token?: string }, {}>('post', urlLogout, { refresh_token })
+}
+
+export const reqMe = () => {
+  return req<{}, User>('get', urlMe)
+}
+
+export type PayloadUser = {
+  username?: string
+  password?: string
+  role?: UserRole
+}
+
+export const reqUsers = () => {
+  return req<{}, User[]>('get', urlUsers)
+}
+
+export const reqUserCreate = (data: PayloadUser) => {
+  return req<PayloadUser, User>('post', urlUsers, data)
+}
+
+export const reqUserUpdate = (id: UserID, data: PayloadUser) => {
+  return req<PayloadUser, User>('put', `${urlUsers}/${id}`, data)
+}
+
+export const reqUserDelete = (id: UserID) => {
+  return req<{}, {}>('delete', `${urlUsers}/${id}`)
+}
+
+export type APIKeyID = ID<'API Key ID'>
+export type APIKeyScope = 'upload' | 'read' | 'admin'
+export type APIKey = {
+  id: APIKeyID
+  name: string
+  scope: APIKeyScope
+  user_id?: UserID
+  created: string
+  last_used?: string
+}
+
+// the key itself is only returned when it's created
+export type APIKeyCreated = APIKey & { key: string }
+
+export type PayloadAPIKeyCreate = {
+  name: string
+  scope: APIKeyScope
+}
+
+export const reqAPIKeys = () => {
+  return req<{}, APIKey[]>('get', urlAPIKeys)
+}
+
+export const reqAPIKeyCreate = (data: PayloadAPIKeyCreate) => {
+  return req<PayloadAPIKeyCreate, APIKeyCreated>('post', urlAPIKeys, data)
+}
+
+export const reqAPIKeyDelete = (id: APIKeyID) => {
+  return req<{}, {}>('delete', `${urlAPIKeys}/${id}`)
+}
+
+export const reqCollections = () => {
+  return req<{}, Collection[]>('get', urlCollections)
+}
+
+export const reqCollection = (id: CollectionID) => {
+  return req<{}, Collection>('get', `${urlCollections}/${id}`)
+}
+
+export type PayloadCollection = {
+  name: string
+  cover_hash?: string
+}
+
+export const reqCollectionCreate = (data: PayloadCollection) => {
+  return req<PayloadCollection, { id: CollectionID }>('post', urlCollections, data)
+}
+
+export const reqCollectionUpdate = (id: CollectionID, data: PayloadCollection) => {
+  return req<PayloadCollection, {}>('put', `${urlCollections}/${id}`, data)
+}
+
+export const reqCollectionDelete = (id: CollectionID) => {
+  return req<{}, {}>('delete', `${urlCollections}/${id}`)
+}
+
+export type PayloadCollectionMedias = {
+  hashes: string[]
+}
+
+export const reqCollectionAdd = (id: CollectionID, data: PayloadCollectionMedias) => {
+  return req<PayloadCollectionMedias, {}>('post', `${urlCollections}/${id}/add`, data)
+}
+
+export const reqCollectionRemove = (id: CollectionID, data: PayloadCollectionMedias) => {
+  return req<PayloadCollectionMedias, {}>('post', `${urlCollections}/${id}/remove`, data)
+}
+
+export const reqCollectionReorder = (id: CollectionID, data: PayloadCollectionMedias) => {
+  return req<PayloadCollectionMedias, {}>('post', `${urlCollections}/${id}/reorder`, data)
+}
+
 const socketGuesses: { [key: string]: string } = {
   'https:': 'wss:',
   'http:': 'ws:',
@@ -124,9 +464,54 @@ const socketHost = window.location.host
 type SocketParams = {
   want_settings?: 0 | 1
   want_media_hash?: string
+  want_all_media?: 0 | 1
   token?: string
 }
 
+export type SocketEventType =
+  | 'import_progress'
+  | 'scan_error'
+  | 'media_created'
+  | 'media_processed'
+  | 'media_deleted'
+  | 'media_restored'
+
+export type SocketImportProgress = {
+  running: boolean
+  count_total: number
+  count_processed: number
+  count_errors: number
+  last_hash: string
+}
+
+export type SocketMediaSummary = {
+  type: MediaType
+  timestamp: string
+  dim_width: number
+  dim_height: number
+  processed: boolean
+  count_blocks: number
+}
+
+export type SocketEvent = {
+  type: SocketEventType
+  time: string
+  hash?: string
+  file_name?: string
+  progress?: SocketImportProgress
+  media?: SocketMediaSummary
+  trashed?: boolean
+  error?: string
+}
+
+export const parseSocketEvent = (msg: MessageEvent): SocketEvent | undefined => {
+  try {
+    return JSON.parse(msg.data)
+  } catch {
+    return undefined
+  }
+}
+
 export const newSocketAuth = (params: SocketParams) => newSocket({ ...params, token: tokenGet() })
 export const newSocket = (params: SocketParams) => {
   // @ts-ignore
@@ -134,6 +519,15 @@ export const newSocket = (params: SocketParams) => {
   return new WebSocket(`${socketProtocol}//${socketHost}${urlSocket}?${paramsEnc}`)
 }
 
+// server-sent events send the same messages as sockets, for when proxies get in the way
+// of sockets. the browser reconnects, and resumes from the last event it received
+export const newEventsAuth = (params: SocketParams) => newEvents({ ...params, token: tokenGet() })
+export const newEvents = (params: SocketParams) => {
+  // @ts-ignore
+  const paramsEnc = new URLSearchParams(params)
+  return new EventSource(`${urlEvents}?${paramsEnc}`)
+}
+
 type ID<U> = number & { __kind: U }
 
 export type BlockID = ID<'Block ID'>
@@ -146,6 +540,21 @@ export type Block = {
   max_x: number
   max_y: number
   body: string
+  manual: boolean
+  spans?: Span[]
+}
+
+export type PayloadBlock = {
+  min_x: number
+  min_y: number
+  max_x: number
+  max_y: number
+  body: string
+}
+
+export type Span = {
+  start: number
+  end: number
 }
 
 export enum MediaType {
@@ -167,32 +576,102 @@ export type Media = {
   blocks?: Block[]
   highlighted_blocks?: Block[]
   directories?: string[]
+  palette?: Colour[]
+  tags?: string[]
+  position?: number
+  colour_distance?: number
   processed: boolean
+  starred?: boolean
+  visibility?: Visibility
+  public?: boolean
+  note: string
+  note_spans?: Span[]
+  deleted_at?: string
+  owner_id?: UserID
+}
+
+export type Colour = {
+  media_id: MediaID
+  index: number
+  hex: string
+  weight: number
+  lab_l: number
+  lab_a: number
+  lab_b: number
 }
 
 export type Similarity = {
-  similarity: number
+  similarity?: number
+  rank?: number
+  headline?: string
 }
 
 export type Search = {
   medias?: (Media & Similarity)[]
+  next_cursor?: string
+  facets?: SearchFacets
   took: number
 }
 
+export type FacetCount = {
+  value: string
+  count: number
+}
+
+export type SearchFacets = {
+  total: number
+  directories: FacetCount[]
+  types: FacetCount[]
+  months: FacetCount[]
+}
+
 export type Authenticate = {
   token: string
+  refresh_token: string
+  user: User
+}
+
+export type UserID = ID<'User ID'>
+export type UserRole = 'admin' | 'member'
+export type User = {
+  id: UserID
+  username: string
+  role: UserRole
+  created: string
 }
 
 export type StartImport = {}
 
 export type About = { [key: string]: number | string }
 
+export type TagCount = {
+  name: string
+  count: number
+}
+
+export type CollectionID = ID<'Collection ID'>
+export type Collection = {
+  id: CollectionID
+  name: string
+  cover_media_id: MediaID | null
+  owner_id?: UserID
+  created: string
+  cover_hash?: string
+  count: number
+}
+
 export type Directory = {
   directory_alias: string
   count: number
+  visibility: Visibility
   is_uploads?: boolean
 }
 
+export enum Visibility {
+  Public = 'public',
+  Private = 'private',
+}
+
 export type ImportStatus = {
   errors: {
     error: string
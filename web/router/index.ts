@@ -6,9 +6,10 @@ import Importer from '~/components/Importer.vue'
 import Login from '~/components/Login.vue'
 import Home from '~/components/Home.vue'
 import Public from '~/components/Public.vue'
+import Share from '~/components/Share.vue'
 import NotFound from '~/components/NotFound.vue'
 
-import { tokenHas, tokenSet } from '~/request'
+import { tokenHas, tokenSet, refreshTokenSet, reqLogout } from '~/request'
 
 export const routes = {
   LOGIN: Symbol(),
@@ -18,6 +19,7 @@ export const routes = {
   IMPORTER: Symbol(),
   SETTINGS: Symbol(),
   PUBLIC: Symbol(),
+  SHARE: Symbol(),
   NOT_FOUND: Symbol(),
 } as const
 
@@ -26,8 +28,10 @@ const beforeCheckAuth: NavigationGuard = (to, _, next) => {
   next({ name: routes.LOGIN, query: { redirect: to.fullPath } })
 }
 
-const beforeLogout: NavigationGuard = (_, __, next) => {
+const beforeLogout: NavigationGuard = async (_, __, next) => {
+  if (tokenHas()) await reqLogout()
   tokenSet('')
+  refreshTokenSet('')
   next({ name: routes.LOGIN })
 }
 
@@ -77,6 +81,11 @@ const records: RouteRecordRaw[] = [
     name: routes.PUBLIC,
     component: Public,
   },
+  {
+    path: '/s/:token',
+    name: routes.SHARE,
+    component: Share,
+  },
   {
     path: '/not-found',
     name: routes.NOT_FOUND,